@@ -15,6 +15,9 @@ package config
 
 import (
 	"fmt"
+	"math"
+	"strconv"
+	"strings"
 	"time"
 
 	multierror "github.com/hashicorp/go-multierror"
@@ -69,6 +72,120 @@ type Module struct {
 	Parity      string         `yaml:"parity"`
 	Metrics     []MetricDef    `yaml:"metrics"`
 	Workarounds Workarounds    `yaml:"workarounds"`
+	TLS         TLSConfig      `yaml:"tls"`
+	// IdleTimeout after which an unused connection to a target is closed.
+	// Defaults to 30s, a negative value closes connections after every
+	// scrape.
+	IdleTimeout time.Duration `yaml:"idleTimeout"`
+	// MaxGap is the number of unused registers (or bits) a read request may
+	// span in order to read neighbouring metrics in one go. Defaults to 0,
+	// i.e. only adjacent and overlapping metrics are read together.
+	MaxGap int `yaml:"maxGap"`
+	// MaxRegistersPerRequest limits the number of registers read by a single
+	// request. Defaults to 125, the maximum of the protocol.
+	MaxRegistersPerRequest int `yaml:"maxRegistersPerRequest"`
+	// ForbiddenRanges are never read, not even to bridge the gap between two
+	// metrics. Devices with non-contiguous register blocks reject requests
+	// crossing the unmapped addresses in between.
+	ForbiddenRanges []AddressRange `yaml:"forbiddenRanges"`
+	// InvalidValuePolicy decides whether readings matching the invalid
+	// values or outside of the valid range of their metric are dropped or
+	// exported as NaN. Defaults to drop.
+	InvalidValuePolicy InvalidValuePolicy `yaml:"invalidValuePolicy"`
+	// Derived metrics are computed from the metrics of the module after
+	// each scrape and exported after them.
+	Derived []DerivedMetricDef `yaml:"derived"`
+}
+
+// InvalidValuePolicy is the handling of readings marked as invalid.
+type InvalidValuePolicy string
+
+const (
+	InvalidValueDrop InvalidValuePolicy = "drop"
+	InvalidValueNaN  InvalidValuePolicy = "nan"
+)
+
+// DerivedMetricDef defines a metric computed from other metrics of the same
+// module, e.g. the sum of the power of all phases.
+type DerivedMetricDef struct {
+	// Name of the metric in the Prometheus output format.
+	Name string `yaml:"name"`
+
+	// Help text of the metric in the Prometheus output format.
+	Help string `yaml:"help"`
+
+	// Labels to be applied to the metric in the Prometheus output format.
+	Labels map[string]string `yaml:"labels"`
+
+	MetricType MetricType `yaml:"metricType"`
+
+	// Expression over the values of metrics and other derived metrics of the
+	// module, referenced by name.
+	Expr string `yaml:"expr"`
+}
+
+// Maximum quantities a single read request may ask for according to the
+// Modbus specification.
+const (
+	MaxRegistersPerRead = 125
+	MaxBitsPerRead      = 2000
+)
+
+// AddressRange is an inclusive range of addresses, given in the same notation
+// as metric addresses, e.g. from 300100 to 300199.
+type AddressRange struct {
+	From RegisterAddr `yaml:"from"`
+	To   RegisterAddr `yaml:"to"`
+}
+
+// validate checks that both ends of the range use the same function code and
+// are in order.
+func (r *AddressRange) validate() error {
+	fromFunction, from, err := r.From.Parse()
+	if err != nil {
+		return err
+	}
+	toFunction, to, err := r.To.Parse()
+	if err != nil {
+		return err
+	}
+
+	if fromFunction != toFunction {
+		return fmt.Errorf("expected range %v to %v to use a single function code", r.From, r.To)
+	}
+	if from > to {
+		return fmt.Errorf("expected start of range %v to %v not to be after its end", r.From, r.To)
+	}
+
+	return nil
+}
+
+// overlaps returns whether any of the count addresses starting at address,
+// read via function, is within the range. Invalid ranges overlap nothing.
+func (r *AddressRange) overlaps(function uint8, address uint16, count int) bool {
+	fromFunction, from, err := r.From.Parse()
+	if err != nil || fromFunction != function {
+		return false
+	}
+	_, to, err := r.To.Parse()
+	if err != nil {
+		return false
+	}
+
+	return int(address) <= int(to) && int(from) < int(address)+count
+}
+
+// TLSConfig configures the client side of Modbus/TCP Security connections.
+type TLSConfig struct {
+	// CA certificate file to verify the server certificate with. The system
+	// roots are used if empty.
+	CAFile string `yaml:"caFile"`
+	// Client certificate and key files presented to the server.
+	CertFile string `yaml:"certFile"`
+	KeyFile  string `yaml:"keyFile"`
+	// Name to verify the server certificate against. Defaults to the host of
+	// the target.
+	ServerName string `yaml:"serverName"`
 }
 
 type Workarounds struct {
@@ -82,6 +199,27 @@ type Workarounds struct {
 // output_, _digital input, _ananlog input, _analog output_.
 type RegisterAddr uint32
 
+// Parse splits the address into the function code, given by the first digit,
+// and the register address given by the remaining digits.
+func (a RegisterAddr) Parse() (uint8, uint16, error) {
+	digits := strconv.FormatUint(uint64(a), 10)
+	if len(digits) < 2 {
+		return 0, 0, fmt.Errorf("expected address %v to consist of a function code and a register address", a)
+	}
+
+	function := digits[0] - '0'
+	if function < 1 || function > 4 {
+		return 0, 0, fmt.Errorf("unsupported function code %v in address %v", function, a)
+	}
+
+	address, err := strconv.ParseUint(digits[1:], 10, 16)
+	if err != nil {
+		return 0, 0, fmt.Errorf("modbus register address is out of range: %v", a)
+	}
+
+	return function, uint16(address), nil
+}
+
 // ModbusDataType is an Enum, representing the possible data types a register
 // value can be interpreted as.
 type ModbusDataType string
@@ -89,15 +227,27 @@ type ModbusDataType string
 func (t *ModbusDataType) validate() error {
 	possibleModbusDataTypes := []ModbusDataType{
 		ModbusBool,
+		ModbusBits,
+		ModbusString,
 		ModbusInt16,
 		ModbusUInt16,
 		ModbusFloat16,
+		ModbusBFloat16,
 		ModbusInt32,
 		ModbusUInt32,
 		ModbusFloat32,
 		ModbusInt64,
 		ModbusUInt64,
 		ModbusFloat64,
+		ModbusBCD16,
+		ModbusBCD32,
+		ModbusBCD64,
+		ModbusInt8,
+		ModbusUInt8,
+		ModbusInt48,
+		ModbusUInt48,
+		ModbusInt,
+		ModbusUInt,
 	}
 
 	if t == nil {
@@ -115,6 +265,25 @@ func (t *ModbusDataType) validate() error {
 		*t)
 }
 
+// bitWidth returns the number of bits of an integer data type, or 0 for other
+// data types.
+func (t ModbusDataType) bitWidth() int {
+	switch t {
+	case ModbusInt8, ModbusUInt8:
+		return 8
+	case ModbusInt16, ModbusUInt16:
+		return 16
+	case ModbusInt32, ModbusUInt32:
+		return 32
+	case ModbusInt48, ModbusUInt48:
+		return 48
+	case ModbusInt64, ModbusUInt64:
+		return 64
+	default:
+		return 0
+	}
+}
+
 const (
 	ModbusBool    ModbusDataType = "bool"
 	ModbusFloat16 ModbusDataType = "float16"
@@ -126,6 +295,32 @@ const (
 	ModbusInt64   ModbusDataType = "int64"
 	ModbusUInt64  ModbusDataType = "uint64"
 	ModbusFloat64 ModbusDataType = "float64"
+
+	// ModbusBFloat16 is the upper half of a float32, i.e. with 8 exponent and
+	// 7 mantissa bits.
+	ModbusBFloat16 ModbusDataType = "bfloat16"
+	// ModbusBits is a run of consecutive coils or discrete inputs.
+	ModbusBits ModbusDataType = "bits"
+	// ModbusString is text stored in consecutive registers, two bytes per
+	// register.
+	ModbusString ModbusDataType = "string"
+
+	ModbusInt48  ModbusDataType = "int48"
+	ModbusUInt48 ModbusDataType = "uint48"
+
+	// Integers spanning Length registers, up to 64 bits.
+	ModbusInt  ModbusDataType = "int"
+	ModbusUInt ModbusDataType = "uint"
+
+	// 8 bit integers in either byte of a register, selected by Byte.
+	ModbusInt8  ModbusDataType = "int8"
+	ModbusUInt8 ModbusDataType = "uint8"
+
+	// Binary coded decimals with one decimal digit per nibble, i.e. four
+	// digits per register.
+	ModbusBCD16 ModbusDataType = "bcd16"
+	ModbusBCD32 ModbusDataType = "bcd32"
+	ModbusBCD64 ModbusDataType = "bcd64"
 )
 
 // EndiannessType is an Enum, representing the possible endianness types a register
@@ -150,17 +345,75 @@ func (endianness *EndiannessType) validate() error {
 		*endianness)
 }
 
+// Order of bytes or registers, most significant first (big) or last
+// (little).
+type Order string
+
+const (
+	OrderBig    Order = "big"
+	OrderLittle Order = "little"
+)
+
 const (
-	// EndiannessBigEndian (1 2 3 4)
+	// EndiannessBigEndian (1 2 3 4), i.e. byteOrder and wordOrder big
 	EndiannessBigEndian EndiannessType = "big"
-	// EndiannessLittleEndian (4 3 2 1)
+	// EndiannessLittleEndian (4 3 2 1), i.e. byteOrder and wordOrder little
 	EndiannessLittleEndian EndiannessType = "little"
-	// EndiannessMixedEndian (2 1 4 3)
+	// EndiannessMixedEndian (2 1 4 3), i.e. byteOrder little
 	EndiannessMixedEndian EndiannessType = "mixed"
-	// EndiannessYolo (3 4 1 2)
+	// EndiannessYolo (3 4 1 2), i.e. wordOrder little
 	EndiannessYolo EndiannessType = "yolo"
 )
 
+// IntegerEncoding is the representation of negative signed integers.
+type IntegerEncoding string
+
+const (
+	EncodingTwosComplement IntegerEncoding = "twos_complement"
+	// EncodingSignMagnitude uses the most significant bit as sign of the
+	// magnitude in the remaining bits.
+	EncodingSignMagnitude IntegerEncoding = "sign_magnitude"
+	// EncodingOnesComplement negates values by inverting all bits.
+	EncodingOnesComplement IntegerEncoding = "ones_complement"
+)
+
+// CalibrationPoint maps a raw value to a calibrated value.
+type CalibrationPoint struct {
+	Raw   float64 `yaml:"raw"`
+	Value float64 `yaml:"value"`
+}
+
+// ValueRange is an inclusive range of values, open ended if Min or Max is
+// unset.
+type ValueRange struct {
+	Min *float64 `yaml:"min,omitempty"`
+	Max *float64 `yaml:"max,omitempty"`
+}
+
+// EnumStateLabel is the label holding the state of enum metrics.
+const EnumStateLabel = "state"
+
+// OutOfRange is the handling of raw values outside of a calibration table.
+type OutOfRange string
+
+const (
+	// OutOfRangeClamp uses the value of the closest point.
+	OutOfRangeClamp OutOfRange = "clamp"
+	// OutOfRangeExtrapolate extends the first or last segment.
+	OutOfRangeExtrapolate OutOfRange = "extrapolate"
+	// OutOfRangeDrop drops the sample.
+	OutOfRangeDrop OutOfRange = "drop"
+)
+
+// ByteSelector selects the high or low byte of a register, after applying the
+// endianness.
+type ByteSelector string
+
+const (
+	ByteHigh ByteSelector = "high"
+	ByteLow  ByteSelector = "low"
+)
+
 // MetricType specifies the Prometheus metric type, see
 // https://prometheus.io/docs/concepts/metric_types/ for details.
 type MetricType string
@@ -207,17 +460,110 @@ type MetricDef struct {
 
 	DataType ModbusDataType `yaml:"dataType"`
 
+	// Endianness is a shorthand for common combinations of ByteOrder,
+	// WordOrder and RegisterOrder and cannot be combined with them.
 	Endianness EndiannessType `yaml:"endianness,omitempty"`
 
+	// ByteOrder of the two bytes within each register.
+	ByteOrder Order `yaml:"byteOrder,omitempty"`
+
+	// WordOrder of the registers of values spanning multiple registers. For
+	// 64 bit values it is the order of the two 32 bit words.
+	WordOrder Order `yaml:"wordOrder,omitempty"`
+
+	// RegisterOrder of the two registers within each 32 bit word of 64 bit
+	// values. Defaults to WordOrder.
+	RegisterOrder Order `yaml:"registerOrder,omitempty"`
+
 	// Bit offset within the input register to parse. Only valid for boolean data
 	// type. The two bytes of a register are interpreted in network order (big
 	// endianness). Boolean is determined via `register&(1<<offset)>0`.
+	// Coils and discrete inputs are single bits and need no offset.
+	// Together with BitLength it selects a bit field of an integer data type.
 	BitOffset *int `yaml:"bitOffset,omitempty"`
 
+	// Number of bits of the field at BitOffset to extract from an integer
+	// data type. Signed types are sign-extended from the top bit of the field.
+	BitLength int `yaml:"bitLength,omitempty"`
+
+	// Encoding of negative values of signed integer data types. Defaults to
+	// two's complement.
+	Encoding IntegerEncoding `yaml:"encoding,omitempty"`
+
+	// Byte of the register holding an 8 bit data type.
+	Byte ByteSelector `yaml:"byte,omitempty"`
+
+	// Number of consecutive coils or discrete inputs exported by the bits
+	// data type, one series per bit labelled with its position.
+	BitCount int `yaml:"bitCount,omitempty"`
+
+	// Number of registers holding the text of the string data type, or the
+	// value of the int and uint data types.
+	Length int `yaml:"length,omitempty"`
+
+	// Label to export the text of the string data type in, on a gauge with
+	// value 1. Defaults to "value".
+	StringLabel string `yaml:"stringLabel,omitempty"`
+
 	MetricType MetricType `yaml:"metricType"`
 
 	// Scaling factor
 	Factor *float64 `yaml:"factor,omitempty"`
+
+	// Offset added to the value after Factor.
+	Offset *float64 `yaml:"offset,omitempty"`
+
+	// Transform applied after Factor and Offset, cannot be combined with
+	// them.
+	Transform *Transform `yaml:"transform,omitempty"`
+
+	// Raw values a device reports if a reading is not available, e.g.
+	// -32768 for int16 or NaN for floats, compared before any scaling.
+	InvalidValues []float64 `yaml:"invalidValues,omitempty"`
+
+	// Range of valid raw values, compared before any scaling.
+	ValidRange *ValueRange `yaml:"validRange,omitempty"`
+
+	// Calibration table mapping the value after the above to the exported
+	// value, interpolating linearly between points ordered by raw value.
+	Calibration []CalibrationPoint `yaml:"calibration,omitempty"`
+
+	// Handling of values outside of the calibration table. Defaults to
+	// clamp.
+	CalibrationOutOfRange OutOfRange `yaml:"calibrationOutOfRange,omitempty"`
+
+	// Enum maps raw values to the names of states. The metric is exported as
+	// one series per state with a "state" label, with value 1 for the
+	// current state and 0 for all others.
+	Enum map[int64]string `yaml:"enum,omitempty"`
+
+	// State of raw values missing from Enum. Defaults to "unknown".
+	EnumUnknown string `yaml:"enumUnknown,omitempty"`
+
+	// Expression computing the value of the metric from its value x after
+	// all of the above, its decoded value raw before any of the above, and
+	// from the values of other metrics of the module referenced by name, e.g.
+	// "sqrt(x^2 + reactive_power^2)".
+	Expr string `yaml:"expr,omitempty"`
+
+	// Address of an int16 register holding a power of ten exponent, the
+	// value is multiplied with before Factor, as used by SunSpec devices.
+	ScaleFactorAddress RegisterAddr `yaml:"scaleFactorAddress,omitempty"`
+}
+
+// Transform is a linear transformation of the value of a metric, applied in
+// the following order:
+//
+//	(value + PreOffset) * Factor / Divisor + PostOffset
+//
+// e.g. (raw - 4000) / 16000 * span + min for a 4-20 mA input.
+type Transform struct {
+	PreOffset float64 `yaml:"preOffset,omitempty"`
+	// Optional, defaults to 1.
+	Factor     *float64 `yaml:"factor,omitempty"`
+	PostOffset float64  `yaml:"postOffset,omitempty"`
+	// Optional, defaults to 1.
+	Divisor *float64 `yaml:"divisor,omitempty"`
 }
 
 // Validate semantically validates the given metric definition.
@@ -231,26 +577,472 @@ func (d *MetricDef) validate() error {
 	}
 
 	// TODO: Does it have to be used with bools though? Or should there be a default?
-	if d.BitOffset != nil && d.DataType != ModbusBool {
-		return fmt.Errorf("bitPosition can only be used with boolean data type")
+	if d.BitOffset != nil && d.DataType != ModbusBool && d.BitLength == 0 {
+		return fmt.Errorf("bitPosition can only be used with boolean data type or together with bitLength")
+	}
+
+	if d.BitLength != 0 {
+		if err := d.validateBitField(); err != nil {
+			return fmt.Errorf("invalid metric definition %v: %v", d.Name, err)
+		}
+	}
+
+	if err := d.validateOrder(); err != nil {
+		return fmt.Errorf("invalid endianness definition %v: %v", d.Name, err)
 	}
 
 	if d.Endianness != "" {
 		if err := d.Endianness.validate(); err != nil {
 			return fmt.Errorf("invalid endianness definition %v: %v", d.Name, err)
 		}
-	} else {
+	} else if d.ByteOrder == "" && d.WordOrder == "" && d.RegisterOrder == "" {
 		d.Endianness = EndiannessBigEndian
 	}
 
-	if d.Factor != nil && d.DataType == ModbusBool {
-		return fmt.Errorf("factor cannot be used with boolean data type")
+	if d.Factor != nil && (d.DataType == ModbusBool || d.DataType == ModbusBits || d.DataType == ModbusString) {
+		return fmt.Errorf("factor cannot be used with %v data type", d.DataType)
+	}
+
+	if d.Offset != nil && (d.DataType == ModbusBool || d.DataType == ModbusBits || d.DataType == ModbusString) {
+		return fmt.Errorf("offset cannot be used with %v data type", d.DataType)
+	}
+
+	if d.Transform != nil {
+		if err := d.validateTransform(); err != nil {
+			return fmt.Errorf("invalid metric definition %v: %v", d.Name, err)
+		}
+	}
+
+	switch d.DataType {
+	case ModbusBool:
+		if err := d.validateBool(); err != nil {
+			return fmt.Errorf("invalid metric definition %v: %v", d.Name, err)
+		}
+	case ModbusBits:
+		if err := d.validateBits(); err != nil {
+			return fmt.Errorf("invalid metric definition %v: %v", d.Name, err)
+		}
+	case ModbusString:
+		if err := d.validateString(); err != nil {
+			return fmt.Errorf("invalid metric definition %v: %v", d.Name, err)
+		}
+	case ModbusInt, ModbusUInt:
+		if d.Length < 1 || d.Length > 4 {
+			return fmt.Errorf("invalid metric definition %v: expected length to be within 1 and 4 registers but got %v",
+				d.Name, d.Length)
+		}
+	}
+
+	switch d.Encoding {
+	case "", EncodingTwosComplement:
+	case EncodingSignMagnitude, EncodingOnesComplement:
+		switch d.DataType {
+		case ModbusInt8, ModbusInt16, ModbusInt32, ModbusInt48, ModbusInt64, ModbusInt:
+		default:
+			return fmt.Errorf("invalid metric definition %v: encoding can only be used with signed integer data types", d.Name)
+		}
+	default:
+		return fmt.Errorf("invalid metric definition %v: expected encoding to be one of %v, %v, %v but got '%v'",
+			d.Name, EncodingTwosComplement, EncodingSignMagnitude, EncodingOnesComplement, d.Encoding)
+	}
+
+	if d.DataType == ModbusInt8 || d.DataType == ModbusUInt8 {
+		if d.Byte != ByteHigh && d.Byte != ByteLow {
+			return fmt.Errorf("invalid metric definition %v: expected byte to be one of %v, %v but got '%v'",
+				d.Name, ByteHigh, ByteLow, d.Byte)
+		}
+	} else if d.Byte != "" {
+		return fmt.Errorf("byte can only be used with int8 and uint8 data types")
+	}
+
+	if d.BitCount != 0 && d.DataType != ModbusBits {
+		return fmt.Errorf("bitCount can only be used with bits data type")
+	}
+
+	if d.Length != 0 && d.DataType != ModbusString && d.DataType != ModbusInt && d.DataType != ModbusUInt {
+		return fmt.Errorf("length can only be used with string, int and uint data types")
+	}
+
+	if d.StringLabel != "" && d.DataType != ModbusString {
+		return fmt.Errorf("stringLabel can only be used with string data type")
 	}
 
 	if d.Factor != nil && *d.Factor == 0.0 {
 		return fmt.Errorf("factor cannot be 0")
 	}
 
+	if len(d.InvalidValues) > 0 || d.ValidRange != nil {
+		if err := d.validateInvalidValues(); err != nil {
+			return fmt.Errorf("invalid metric definition %v: %v", d.Name, err)
+		}
+	}
+
+	if len(d.Calibration) > 0 || d.CalibrationOutOfRange != "" {
+		if err := d.validateCalibration(); err != nil {
+			return fmt.Errorf("invalid metric definition %v: %v", d.Name, err)
+		}
+	}
+
+	if len(d.Enum) > 0 || d.EnumUnknown != "" {
+		if err := d.validateEnum(); err != nil {
+			return fmt.Errorf("invalid metric definition %v: %v", d.Name, err)
+		}
+	}
+
+	if d.Expr != "" {
+		if d.DataType == ModbusBits || d.DataType == ModbusString {
+			return fmt.Errorf("expr cannot be used with %v data type", d.DataType)
+		}
+		if _, err := ParseExpr(d.Expr); err != nil {
+			return fmt.Errorf("invalid metric definition %v: expr: %v", d.Name, err)
+		}
+	}
+
+	if d.ScaleFactorAddress != 0 {
+		if err := d.validateScaleFactor(); err != nil {
+			return fmt.Errorf("invalid metric definition %v: %v", d.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// validateTransform checks that the transform replaces factor and offset of a
+// numeric metric and does not divide by zero.
+func (d *MetricDef) validateTransform() error {
+	switch d.DataType {
+	case ModbusBool, ModbusBits, ModbusString:
+		return fmt.Errorf("transform cannot be used with %v data type", d.DataType)
+	}
+
+	if d.Factor != nil || d.Offset != nil {
+		return fmt.Errorf("transform cannot be combined with factor or offset")
+	}
+
+	t := d.Transform
+	if t.Factor != nil && *t.Factor == 0.0 {
+		return fmt.Errorf("transform factor cannot be 0")
+	}
+	if t.Divisor != nil && *t.Divisor == 0.0 {
+		return fmt.Errorf("transform divisor cannot be 0")
+	}
+
+	for name, v := range map[string]*float64{
+		"preOffset":  &t.PreOffset,
+		"factor":     t.Factor,
+		"postOffset": &t.PostOffset,
+		"divisor":    t.Divisor,
+	} {
+		if v != nil && (math.IsNaN(*v) || math.IsInf(*v, 0)) {
+			return fmt.Errorf("transform %v must be a finite number", name)
+		}
+	}
+
+	return nil
+}
+
+// validateInvalidValues checks that invalid values and the valid range are
+// only used with numeric metrics and that the range is not empty.
+func (d *MetricDef) validateInvalidValues() error {
+	switch d.DataType {
+	case ModbusBits, ModbusString:
+		return fmt.Errorf("invalidValues and validRange cannot be used with %v data type", d.DataType)
+	}
+
+	if r := d.ValidRange; r != nil {
+		if r.Min == nil && r.Max == nil {
+			return fmt.Errorf("expected validRange to have min or max")
+		}
+		if r.Min != nil && r.Max != nil && !(*r.Min <= *r.Max) {
+			return fmt.Errorf("expected min %v of validRange to be at most max %v", *r.Min, *r.Max)
+		}
+	}
+
+	return nil
+}
+
+// validateEnum checks that the states of an enum are unique and that the raw
+// value is not transformed before being mapped to them.
+func (d *MetricDef) validateEnum() error {
+	switch d.DataType {
+	case ModbusBits, ModbusString:
+		return fmt.Errorf("enum cannot be used with %v data type", d.DataType)
+	}
+
+	if len(d.Enum) == 0 {
+		return fmt.Errorf("enumUnknown can only be used together with enum")
+	}
+	if d.MetricType != MetricTypeGauge {
+		return fmt.Errorf("enums can only be exported as gauge")
+	}
+	if d.Factor != nil || d.Offset != nil || d.Transform != nil || d.ScaleFactorAddress != 0 ||
+		len(d.Calibration) > 0 || d.Expr != "" {
+		return fmt.Errorf("enum cannot be combined with factor, offset, transform, scaleFactorAddress, calibration or expr")
+	}
+	if _, ok := d.Labels[EnumStateLabel]; ok {
+		return fmt.Errorf("label %v is reserved for the state of the enum", EnumStateLabel)
+	}
+
+	states := map[string]bool{d.UnknownState(): true}
+	for _, state := range d.Enum {
+		if state == "" {
+			return fmt.Errorf("expected enum states to have a name")
+		}
+		if states[state] {
+			return fmt.Errorf("enum state %v is not unique", state)
+		}
+		states[state] = true
+	}
+
+	return nil
+}
+
+// UnknownState returns the state of raw values missing from the enum.
+func (d *MetricDef) UnknownState() string {
+	if d.EnumUnknown == "" {
+		return "unknown"
+	}
+	return d.EnumUnknown
+}
+
+// HasSingleValue returns whether the metric is exported as a single series,
+// which can be referenced by expressions.
+func (d *MetricDef) HasSingleValue() bool {
+	return d.DataType != ModbusBits && d.DataType != ModbusString && len(d.Enum) == 0
+}
+
+// validateCalibration checks that the calibration table of a numeric metric
+// has at least two points in strictly increasing order of raw values.
+func (d *MetricDef) validateCalibration() error {
+	switch d.DataType {
+	case ModbusBool, ModbusBits, ModbusString:
+		return fmt.Errorf("calibration cannot be used with %v data type", d.DataType)
+	}
+
+	if len(d.Calibration) < 2 {
+		return fmt.Errorf("expected calibration to have at least 2 points but got %v", len(d.Calibration))
+	}
+	for i := 1; i < len(d.Calibration); i++ {
+		if !(d.Calibration[i].Raw > d.Calibration[i-1].Raw) {
+			return fmt.Errorf("expected raw values of calibration to be strictly increasing but got %v after %v",
+				d.Calibration[i].Raw, d.Calibration[i-1].Raw)
+		}
+	}
+	for _, p := range d.Calibration {
+		if math.IsInf(p.Value, 0) || math.IsNaN(p.Value) || math.IsInf(p.Raw, 0) {
+			return fmt.Errorf("expected calibration points to be finite but got raw %v, value %v", p.Raw, p.Value)
+		}
+	}
+
+	switch d.CalibrationOutOfRange {
+	case "", OutOfRangeClamp, OutOfRangeExtrapolate, OutOfRangeDrop:
+	default:
+		return fmt.Errorf("expected calibrationOutOfRange to be one of %v, %v, %v but got '%v'",
+			OutOfRangeClamp, OutOfRangeExtrapolate, OutOfRangeDrop, d.CalibrationOutOfRange)
+	}
+
+	return nil
+}
+
+// validateScaleFactor checks that the scale factor is read from a register of
+// a numeric metric.
+func (d *MetricDef) validateScaleFactor() error {
+	switch d.DataType {
+	case ModbusBool, ModbusBits, ModbusString:
+		return fmt.Errorf("scaleFactorAddress cannot be used with %v data type", d.DataType)
+	}
+
+	function, _, err := d.ScaleFactorAddress.Parse()
+	if err != nil {
+		return fmt.Errorf("scaleFactorAddress: %v", err)
+	}
+	if function != 3 && function != 4 {
+		return fmt.Errorf("expected scaleFactorAddress to be a holding or input register but got %v", d.ScaleFactorAddress)
+	}
+
+	return nil
+}
+
+// validateBool checks that a boolean either reads a coil or discrete input, or
+// a bit within a register.
+func (d *MetricDef) validateBool() error {
+	function, _, err := d.Address.Parse()
+	if err != nil {
+		return err
+	}
+
+	if function == 1 || function == 2 {
+		if d.BitOffset != nil && *d.BitOffset != 0 {
+			return fmt.Errorf("bitOffset cannot be used with coils and discrete inputs")
+		}
+		return nil
+	}
+
+	if d.BitOffset == nil {
+		return fmt.Errorf("expected bitOffset for boolean in register %v", d.Address)
+	}
+	if *d.BitOffset < 0 || *d.BitOffset > 15 {
+		return fmt.Errorf("expected bitOffset to be within 0 and 15 but got %v", *d.BitOffset)
+	}
+
+	return nil
+}
+
+// validateOrder checks that byte, word and register order are valid and make
+// sense for the number of registers of the data type.
+func (d *MetricDef) validateOrder() error {
+	if d.Endianness != "" && (d.ByteOrder != "" || d.WordOrder != "" || d.RegisterOrder != "") {
+		return fmt.Errorf("endianness cannot be combined with byteOrder, wordOrder or registerOrder")
+	}
+
+	for name, o := range map[string]Order{"byteOrder": d.ByteOrder, "wordOrder": d.WordOrder, "registerOrder": d.RegisterOrder} {
+		if o != "" && o != OrderBig && o != OrderLittle {
+			return fmt.Errorf("expected %v to be one of %v, %v but got '%v'", name, OrderBig, OrderLittle, o)
+		}
+	}
+
+	// The bit of a boolean in a register is selected in network order, like
+	// that of a coil.
+	registers := d.RegisterCount()
+	if d.DataType == ModbusBool {
+		registers = 0
+	}
+	if registers == 0 && (d.ByteOrder != "" || d.WordOrder != "" || d.RegisterOrder != "" ||
+		d.Endianness != "" && d.Endianness != EndiannessBigEndian) {
+		return fmt.Errorf("%v data type has no byte order", d.DataType)
+	}
+	if registers == 1 && (d.WordOrder != "" || d.Endianness == EndiannessYolo) {
+		return fmt.Errorf("%v data type spans a single register and has no word order", d.DataType)
+	}
+	// Older releases read single registers with mixed endianness as big
+	// endian, reject it rather than swapping their bytes silently.
+	if registers == 1 && d.Endianness == EndiannessMixedEndian {
+		return fmt.Errorf("mixed endianness is not supported by the single register %v data type, use byteOrder: little to swap its bytes", d.DataType)
+	}
+	if (registers != 4 || d.DataType == ModbusString) && d.RegisterOrder != "" {
+		return fmt.Errorf("registerOrder can only be used with 64 bit data types")
+	}
+
+	return nil
+}
+
+// Orders returns the byte, word and register order of the definition,
+// resolving its endianness. Unset orders default to big, the register order
+// to the word order.
+func (d *MetricDef) Orders() (Order, Order, Order) {
+	byteOrder, wordOrder, registerOrder := d.ByteOrder, d.WordOrder, d.RegisterOrder
+
+	switch d.Endianness {
+	case EndiannessLittleEndian:
+		byteOrder, wordOrder = OrderLittle, OrderLittle
+	case EndiannessMixedEndian:
+		byteOrder = OrderLittle
+	case EndiannessYolo:
+		wordOrder = OrderLittle
+	}
+
+	if byteOrder == "" {
+		byteOrder = OrderBig
+	}
+	if wordOrder == "" {
+		wordOrder = OrderBig
+	}
+	if registerOrder == "" {
+		registerOrder = wordOrder
+	}
+
+	return byteOrder, wordOrder, registerOrder
+}
+
+// RegisterCount returns the number of registers holding the value of the
+// definition, or 0 for coils and discrete inputs read as bits.
+func (d *MetricDef) RegisterCount() int {
+	switch d.DataType {
+	case ModbusBits:
+		return 0
+	case ModbusString, ModbusInt, ModbusUInt:
+		return d.Length
+	case ModbusBool, ModbusInt8, ModbusUInt8, ModbusInt16, ModbusUInt16,
+		ModbusFloat16, ModbusBFloat16, ModbusBCD16:
+		return 1
+	case ModbusInt32, ModbusUInt32, ModbusFloat32, ModbusBCD32:
+		return 2
+	case ModbusInt48, ModbusUInt48:
+		return 3
+	default:
+		return 4
+	}
+}
+
+// validateBitField checks that the bit field selected by BitOffset and
+// BitLength fits into the integer data type.
+func (d *MetricDef) validateBitField() error {
+	width := d.DataType.bitWidth()
+	if d.DataType == ModbusInt || d.DataType == ModbusUInt {
+		width = 16 * d.Length
+	}
+	if width == 0 {
+		return fmt.Errorf("bitLength can only be used with integer data types")
+	}
+
+	offset := 0
+	if d.BitOffset != nil {
+		offset = *d.BitOffset
+	}
+	if offset < 0 || d.BitLength < 1 || offset+d.BitLength > width {
+		return fmt.Errorf("expected bitOffset %v plus bitLength %v to fit into the %v bits of %v",
+			offset, d.BitLength, width, d.DataType)
+	}
+
+	return nil
+}
+
+// validateBits checks that bits are read from coils or discrete inputs.
+func (d *MetricDef) validateBits() error {
+	function, _, err := d.Address.Parse()
+	if err != nil {
+		return err
+	}
+
+	if function != 1 && function != 2 {
+		return fmt.Errorf("bits can only be read from coils and discrete inputs, not from address %v", d.Address)
+	}
+	if d.BitCount < 1 || d.BitCount > 2000 {
+		return fmt.Errorf("expected bitCount to be within 1 and 2000 but got %v", d.BitCount)
+	}
+	if _, ok := d.Labels["bit"]; ok {
+		return fmt.Errorf("label bit is reserved for the position of the bit")
+	}
+
+	return nil
+}
+
+// validateString checks that a string is read from registers and exported as
+// an info metric.
+func (d *MetricDef) validateString() error {
+	function, _, err := d.Address.Parse()
+	if err != nil {
+		return err
+	}
+
+	if function != 3 && function != 4 {
+		return fmt.Errorf("strings can only be read from registers, not from address %v", d.Address)
+	}
+	if d.Length < 1 || d.Length > 125 {
+		return fmt.Errorf("expected length to be within 1 and 125 registers but got %v", d.Length)
+	}
+	if d.MetricType != MetricTypeGauge {
+		return fmt.Errorf("strings can only be exported as gauge")
+	}
+
+	label := d.StringLabel
+	if label == "" {
+		label = "value"
+	}
+	if _, ok := d.Labels[label]; ok {
+		return fmt.Errorf("label %v is reserved for the text of the string", label)
+	}
+
 	return nil
 }
 
@@ -260,6 +1052,22 @@ type ModbusProtocol string
 const (
 	// ModbusProtocolTCPIP represents modbus via TCP/IP.
 	ModbusProtocolTCPIP = "tcp/ip"
+	// ModbusProtocolRTU represents modbus RTU via a local serial device.
+	ModbusProtocolRTU = "rtu"
+	// ModbusProtocolRTUOverTCP represents modbus RTU frames sent over a TCP
+	// connection, as done by transparent serial device servers.
+	ModbusProtocolRTUOverTCP = "rtu-over-tcp"
+	// ModbusProtocolASCII represents modbus ASCII via a local serial device.
+	ModbusProtocolASCII = "ascii"
+	// ModbusProtocolASCIIOverTCP represents modbus ASCII frames sent over a
+	// TCP connection, as done by transparent serial device servers.
+	ModbusProtocolASCIIOverTCP = "ascii-over-tcp"
+	// ModbusProtocolUDP represents modbus via UDP, using the same framing as
+	// TCP/IP.
+	ModbusProtocolUDP = "udp"
+	// ModbusProtocolTCPTLS represents the Modbus/TCP Security protocol, i.e.
+	// modbus via TCP/IP wrapped in mutually authenticated TLS.
+	ModbusProtocolTCPTLS = "tcp+tls"
 )
 
 // ModbusProtocolValidationError is returned on invalid or unsupported modbus
@@ -276,6 +1084,12 @@ func (e *ModbusProtocolValidationError) Error() string {
 func (t *ModbusProtocol) validate() error {
 	possibleProtocols := []ModbusProtocol{
 		ModbusProtocolTCPIP,
+		ModbusProtocolRTU,
+		ModbusProtocolRTUOverTCP,
+		ModbusProtocolASCII,
+		ModbusProtocolASCIIOverTCP,
+		ModbusProtocolUDP,
+		ModbusProtocolTCPTLS,
 	}
 
 	if t == nil {
@@ -301,6 +1115,44 @@ func (s *Module) validate() error {
 		err = multierror.Append(err, protocolErr)
 	}
 
+	if s.Protocol == ModbusProtocolRTU || s.Protocol == ModbusProtocolASCII {
+		if serialErr := s.validateSerial(); serialErr != nil {
+			err = multierror.Append(err, serialErr)
+		}
+	}
+
+	if s.Protocol == ModbusProtocolTCPTLS {
+		if tlsErr := s.validateTLS(); tlsErr != nil {
+			err = multierror.Append(err, tlsErr)
+		}
+	}
+
+	switch s.InvalidValuePolicy {
+	case "", InvalidValueDrop, InvalidValueNaN:
+	default:
+		err = multierror.Append(err, fmt.Errorf("expected invalidValuePolicy to be one of %v, %v but got '%v' in module %s",
+			InvalidValueDrop, InvalidValueNaN, s.InvalidValuePolicy, s.Name))
+	}
+
+	if s.MaxGap < 0 {
+		err = multierror.Append(err, fmt.Errorf("invalid maxGap %v in module %s", s.MaxGap, s.Name))
+	}
+
+	if s.MaxRegistersPerRequest < 0 || s.MaxRegistersPerRequest > 125 {
+		err = multierror.Append(err, fmt.Errorf("expected maxRegistersPerRequest to be within 1 and 125 but got %v in module %s",
+			s.MaxRegistersPerRequest, s.Name))
+	}
+
+	for _, r := range s.ForbiddenRanges {
+		if rangeErr := r.validate(); rangeErr != nil {
+			err = multierror.Append(err, fmt.Errorf("invalid forbidden range in module %s: %v", s.Name, rangeErr))
+		}
+	}
+
+	if requestErr := s.validateRequests(); requestErr != nil {
+		err = multierror.Append(err, requestErr)
+	}
+
 	// track that error if we have no register definitions
 	if len(s.Metrics) == 0 {
 		noRegErr := fmt.Errorf("no metric definitions found in module %s", s.Name)
@@ -313,5 +1165,265 @@ func (s *Module) validate() error {
 		}
 	}
 
+	if exprErr := s.validateExpressions(); exprErr != nil {
+		err = multierror.Append(err, exprErr)
+	}
+
+	if derivedErr := s.validateDerived(); derivedErr != nil {
+		err = multierror.Append(err, derivedErr)
+	}
+
 	return err
 }
+
+// validateRequests checks that every metric, and the register of its scale
+// factor, can be read with a single request within the limits of the module
+// and outside of its forbidden ranges.
+func (s *Module) validateRequests() error {
+	var err error
+
+	forbidden := func(function uint8, address uint16, count int) bool {
+		for _, r := range s.ForbiddenRanges {
+			if r.overlaps(function, address, count) {
+				return true
+			}
+		}
+		return false
+	}
+
+	for _, def := range s.Metrics {
+		// Invalid addresses are reported by the validation of the metric.
+		function, address, parseErr := def.Address.Parse()
+		if parseErr == nil {
+			count, limit := def.RegisterCount(), MaxRegistersPerRead
+			if s.MaxRegistersPerRequest > 0 {
+				limit = s.MaxRegistersPerRequest
+			}
+			if def.DataType == ModbusBits {
+				count, limit = def.BitCount, MaxBitsPerRead
+			}
+
+			if count > limit {
+				err = multierror.Append(err, fmt.Errorf("metric %v in module %s needs %v registers, more than the %v allowed per request",
+					def.Name, s.Name, count, limit))
+			}
+			if forbidden(function, address, max(count, 1)) {
+				err = multierror.Append(err, fmt.Errorf("metric %v in module %s: address %v is within a forbidden range",
+					def.Name, s.Name, def.Address))
+			}
+		}
+
+		if def.ScaleFactorAddress != 0 {
+			function, address, parseErr := def.ScaleFactorAddress.Parse()
+			if parseErr == nil && forbidden(function, address, 1) {
+				err = multierror.Append(err, fmt.Errorf("metric %v in module %s: scale factor address %v is within a forbidden range",
+					def.Name, s.Name, def.ScaleFactorAddress))
+			}
+		}
+	}
+
+	return err
+}
+
+// validateExpressions checks that expressions only reference x and metrics of
+// the module with a single value, identified by a unique name.
+func (s *Module) validateExpressions() error {
+	count := map[string]int{}
+	valid := map[string]bool{}
+	for _, def := range s.Metrics {
+		count[def.Name]++
+		valid[def.Name] = def.HasSingleValue()
+	}
+
+	var err error
+	for _, def := range s.Metrics {
+		if def.Expr == "" {
+			continue
+		}
+		expr, parseErr := ParseExpr(def.Expr)
+		if parseErr != nil {
+			continue
+		}
+
+		for _, v := range expr.Variables() {
+			switch {
+			case v == ExprValueVariable, v == ExprRawVariable:
+			case count[v] == 0:
+				err = multierror.Append(err, fmt.Errorf("expr of metric %v in module %s references unknown metric %v",
+					def.Name, s.Name, v))
+			case count[v] > 1:
+				err = multierror.Append(err, fmt.Errorf("expr of metric %v in module %s references ambiguous metric %v",
+					def.Name, s.Name, v))
+			case !valid[v]:
+				err = multierror.Append(err, fmt.Errorf("expr of metric %v in module %s references metric %v without a single value",
+					def.Name, s.Name, v))
+			}
+		}
+	}
+
+	return err
+}
+
+// validateDerived checks that derived metrics have a unique name and reference
+// metrics and derived metrics of the module, without depending on themselves.
+func (s *Module) validateDerived() error {
+	count := map[string]int{}
+	valid := map[string]bool{}
+	for _, def := range s.Metrics {
+		count[def.Name]++
+		valid[def.Name] = def.HasSingleValue()
+	}
+	for _, def := range s.Derived {
+		count[def.Name]++
+		valid[def.Name] = true
+	}
+
+	var err error
+	for _, def := range s.Derived {
+		if def.Name == "" {
+			err = multierror.Append(err, fmt.Errorf("derived metric without name in module %s", s.Name))
+			continue
+		}
+		// Metrics of the same name would be registered with inconsistent
+		// labels or types.
+		if count[def.Name] > 1 {
+			err = multierror.Append(err, fmt.Errorf("derived metric %v in module %s has the same name as another metric",
+				def.Name, s.Name))
+			continue
+		}
+		if typeErr := def.MetricType.validate(); typeErr != nil {
+			err = multierror.Append(err, fmt.Errorf("invalid derived metric %v in module %s: %v", def.Name, s.Name, typeErr))
+			continue
+		}
+
+		expr, parseErr := ParseExpr(def.Expr)
+		if parseErr != nil {
+			err = multierror.Append(err, fmt.Errorf("invalid derived metric %v in module %s: expr: %v", def.Name, s.Name, parseErr))
+			continue
+		}
+
+		for _, v := range expr.Variables() {
+			switch {
+			case count[v] == 0:
+				err = multierror.Append(err, fmt.Errorf("derived metric %v in module %s references unknown metric %v",
+					def.Name, s.Name, v))
+			case count[v] > 1:
+				err = multierror.Append(err, fmt.Errorf("derived metric %v in module %s references ambiguous metric %v",
+					def.Name, s.Name, v))
+			case !valid[v]:
+				err = multierror.Append(err, fmt.Errorf("derived metric %v in module %s references metric %v without a single value",
+					def.Name, s.Name, v))
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, orderErr := s.DerivedOrder(); orderErr != nil {
+		return fmt.Errorf("invalid derived metrics in module %s: %v", s.Name, orderErr)
+	}
+
+	return nil
+}
+
+// DerivedOrder returns the indices of the derived metrics in an order in which
+// each derived metric comes after the derived metrics it references. It fails
+// if derived metrics depend on each other in a cycle.
+func (s *Module) DerivedOrder() ([]int, error) {
+	index := map[string]int{}
+	for i, def := range s.Derived {
+		index[def.Name] = i
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(s.Derived))
+	order := make([]int, 0, len(s.Derived))
+	path := []string{}
+
+	var visit func(i int) error
+	visit = func(i int) error {
+		switch state[i] {
+		case visited:
+			return nil
+		case visiting:
+			start := 0
+			for path[start] != s.Derived[i].Name {
+				start++
+			}
+			cycle := append(append([]string{}, path[start:]...), s.Derived[i].Name)
+			return fmt.Errorf("dependency cycle %v", strings.Join(cycle, " -> "))
+		}
+
+		state[i] = visiting
+		path = append(path, s.Derived[i].Name)
+
+		expr, err := ParseExpr(s.Derived[i].Expr)
+		if err != nil {
+			return fmt.Errorf("derived metric %v: expr: %v", s.Derived[i].Name, err)
+		}
+		for _, v := range expr.Variables() {
+			if j, ok := index[v]; ok {
+				if err := visit(j); err != nil {
+					return err
+				}
+			}
+		}
+
+		path = path[:len(path)-1]
+		state[i] = visited
+		order = append(order, i)
+		return nil
+	}
+
+	for i := range s.Derived {
+		if err := visit(i); err != nil {
+			return nil, err
+		}
+	}
+
+	return order, nil
+}
+
+// validateSerial checks the serial line settings of a module. Zero values are
+// valid and select the Modbus defaults of 19200 baud, 8 data bits (7 with
+// ascii), 1 stop bit and even parity.
+func (s *Module) validateSerial() error {
+	if s.Baudrate < 0 {
+		return fmt.Errorf("invalid baudrate %v in module %s", s.Baudrate, s.Name)
+	}
+
+	switch s.Databits {
+	case 0, 5, 6, 7, 8:
+	default:
+		return fmt.Errorf("expected databits to be one of 5, 6, 7, 8 but got %v in module %s", s.Databits, s.Name)
+	}
+
+	switch s.Stopbits {
+	case 0, 1, 2:
+	default:
+		return fmt.Errorf("expected stopbits to be one of 1, 2 but got %v in module %s", s.Stopbits, s.Name)
+	}
+
+	switch s.Parity {
+	case "", "N", "E", "O":
+	default:
+		return fmt.Errorf("expected parity to be one of N, E, O but got '%v' in module %s", s.Parity, s.Name)
+	}
+
+	return nil
+}
+
+// validateTLS checks the TLS settings of a module. Modbus/TCP Security
+// requires the client to authenticate with a certificate.
+func (s *Module) validateTLS() error {
+	if s.TLS.CertFile == "" || s.TLS.KeyFile == "" {
+		return fmt.Errorf("protocol %v requires tls certFile and keyFile in module %s", s.Protocol, s.Name)
+	}
+
+	return nil
+}
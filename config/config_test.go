@@ -15,11 +15,13 @@ package config
 
 import (
 	"fmt"
+	"strings"
 	"testing"
 )
 
 func TestMetricDefValidate(t *testing.T) {
 	one := 1
+	negativeOffset, divisor, zero := -273.15, 16000.0, 0.0
 	for _, test := range []struct {
 		name        string
 		metricDef   MetricDef
@@ -28,11 +30,105 @@ func TestMetricDefValidate(t *testing.T) {
 		{
 			"bool",
 			MetricDef{
+				Address:    100001,
 				DataType:   ModbusBool,
 				MetricType: MetricTypeCounter,
 			},
 			nil,
 		},
+		{
+			"bool in register",
+			MetricDef{
+				Name:       "status",
+				Address:    300001,
+				DataType:   ModbusBool,
+				MetricType: MetricTypeGauge,
+			},
+			fmt.Errorf("invalid metric definition status: expected bitOffset for boolean in register 300001"),
+		},
+		{
+			"bool in register with bitOffset",
+			MetricDef{
+				Address:    300001,
+				DataType:   ModbusBool,
+				BitOffset:  &one,
+				MetricType: MetricTypeGauge,
+			},
+			nil,
+		},
+		{
+			"bool coil with bitOffset",
+			MetricDef{
+				Name:       "coil",
+				Address:    100001,
+				DataType:   ModbusBool,
+				BitOffset:  &one,
+				MetricType: MetricTypeGauge,
+			},
+			fmt.Errorf("invalid metric definition coil: bitOffset cannot be used with coils and discrete inputs"),
+		},
+		{
+			"bits",
+			MetricDef{
+				Address:    200001,
+				DataType:   ModbusBits,
+				BitCount:   16,
+				MetricType: MetricTypeGauge,
+			},
+			nil,
+		},
+		{
+			"bits in register",
+			MetricDef{
+				Name:       "flags",
+				Address:    400001,
+				DataType:   ModbusBits,
+				BitCount:   16,
+				MetricType: MetricTypeGauge,
+			},
+			fmt.Errorf("invalid metric definition flags: bits can only be read from coils and discrete inputs, not from address 400001"),
+		},
+		{
+			"string",
+			MetricDef{
+				Address:    400100,
+				DataType:   ModbusString,
+				Length:     8,
+				MetricType: MetricTypeGauge,
+			},
+			nil,
+		},
+		{
+			"string without length",
+			MetricDef{
+				Name:       "serial_info",
+				Address:    400100,
+				DataType:   ModbusString,
+				MetricType: MetricTypeGauge,
+			},
+			fmt.Errorf("invalid metric definition serial_info: expected length to be within 1 and 125 registers but got 0"),
+		},
+		{
+			"string as counter",
+			MetricDef{
+				Name:       "serial_info",
+				Address:    400100,
+				DataType:   ModbusString,
+				Length:     8,
+				MetricType: MetricTypeCounter,
+			},
+			fmt.Errorf("invalid metric definition serial_info: strings can only be exported as gauge"),
+		},
+		{
+			"bits without bitCount",
+			MetricDef{
+				Name:       "flags",
+				Address:    100001,
+				DataType:   ModbusBits,
+				MetricType: MetricTypeGauge,
+			},
+			fmt.Errorf("invalid metric definition flags: expected bitCount to be within 1 and 2000 but got 0"),
+		},
 		{
 			"bool",
 			MetricDef{
@@ -40,7 +136,475 @@ func TestMetricDefValidate(t *testing.T) {
 				BitOffset:  &one,
 				MetricType: MetricTypeCounter,
 			},
-			fmt.Errorf("bitPosition can only be used with boolean data type"),
+			fmt.Errorf("bitPosition can only be used with boolean data type or together with bitLength"),
+		},
+		{
+			"bit field",
+			MetricDef{
+				DataType:   ModbusUInt32,
+				BitOffset:  &one,
+				BitLength:  31,
+				MetricType: MetricTypeGauge,
+			},
+			nil,
+		},
+		{
+			"bit field exceeding type",
+			MetricDef{
+				Name:       "state",
+				DataType:   ModbusInt16,
+				BitOffset:  &one,
+				BitLength:  16,
+				MetricType: MetricTypeGauge,
+			},
+			fmt.Errorf("invalid metric definition state: expected bitOffset 1 plus bitLength 16 to fit into the 16 bits of int16"),
+		},
+		{
+			"uint8",
+			MetricDef{
+				DataType:   ModbusUInt8,
+				Byte:       ByteLow,
+				MetricType: MetricTypeGauge,
+			},
+			nil,
+		},
+		{
+			"int8 without byte",
+			MetricDef{
+				Name:       "minute",
+				DataType:   ModbusInt8,
+				MetricType: MetricTypeGauge,
+			},
+			fmt.Errorf("invalid metric definition minute: expected byte to be one of high, low but got ''"),
+		},
+		{
+			"byte with int16",
+			MetricDef{
+				DataType:   ModbusInt16,
+				Byte:       ByteHigh,
+				MetricType: MetricTypeGauge,
+			},
+			fmt.Errorf("byte can only be used with int8 and uint8 data types"),
+		},
+		{
+			"int48 bit field",
+			MetricDef{
+				DataType:   ModbusInt48,
+				BitOffset:  &one,
+				BitLength:  47,
+				MetricType: MetricTypeGauge,
+			},
+			nil,
+		},
+		{
+			"uint over five registers",
+			MetricDef{
+				Name:       "energy",
+				DataType:   ModbusUInt,
+				Length:     5,
+				MetricType: MetricTypeCounter,
+			},
+			fmt.Errorf("invalid metric definition energy: expected length to be within 1 and 4 registers but got 5"),
+		},
+		{
+			"byte and word order",
+			MetricDef{
+				DataType:      ModbusFloat64,
+				ByteOrder:     OrderLittle,
+				WordOrder:     OrderBig,
+				RegisterOrder: OrderLittle,
+				MetricType:    MetricTypeGauge,
+			},
+			nil,
+		},
+		{
+			"endianness and byte order",
+			MetricDef{
+				Name:       "power",
+				DataType:   ModbusFloat32,
+				Endianness: EndiannessMixedEndian,
+				ByteOrder:  OrderLittle,
+				MetricType: MetricTypeGauge,
+			},
+			fmt.Errorf("invalid endianness definition power: endianness cannot be combined with byteOrder, wordOrder or registerOrder"),
+		},
+		{
+			"word order of single register",
+			MetricDef{
+				Name:       "power",
+				DataType:   ModbusInt16,
+				WordOrder:  OrderLittle,
+				MetricType: MetricTypeGauge,
+			},
+			fmt.Errorf("invalid endianness definition power: int16 data type spans a single register and has no word order"),
+		},
+		{
+			"yolo endianness of single register",
+			MetricDef{
+				Name:       "power",
+				DataType:   ModbusUInt16,
+				Endianness: EndiannessYolo,
+				MetricType: MetricTypeGauge,
+			},
+			fmt.Errorf("invalid endianness definition power: uint16 data type spans a single register and has no word order"),
+		},
+		{
+			"mixed endianness of single register",
+			MetricDef{
+				Name:       "power",
+				DataType:   ModbusInt16,
+				Endianness: EndiannessMixedEndian,
+				MetricType: MetricTypeGauge,
+			},
+			fmt.Errorf("invalid endianness definition power: mixed endianness is not supported by the single register int16 data type, use byteOrder: little to swap its bytes"),
+		},
+		{
+			"register order of 32 bit",
+			MetricDef{
+				Name:          "power",
+				DataType:      ModbusUInt32,
+				RegisterOrder: OrderLittle,
+				MetricType:    MetricTypeGauge,
+			},
+			fmt.Errorf("invalid endianness definition power: registerOrder can only be used with 64 bit data types"),
+		},
+		{
+			"byte order of bool",
+			MetricDef{
+				Name:       "status",
+				Address:    300001,
+				DataType:   ModbusBool,
+				BitOffset:  &one,
+				ByteOrder:  OrderLittle,
+				MetricType: MetricTypeGauge,
+			},
+			fmt.Errorf("invalid endianness definition status: bool data type has no byte order"),
+		},
+		{
+			"endianness of coil",
+			MetricDef{
+				Name:       "coil",
+				Address:    100001,
+				DataType:   ModbusBool,
+				Endianness: EndiannessLittleEndian,
+				MetricType: MetricTypeGauge,
+			},
+			fmt.Errorf("invalid endianness definition coil: bool data type has no byte order"),
+		},
+		{
+			"endianness of bits",
+			MetricDef{
+				Name:       "alarm",
+				Address:    100001,
+				DataType:   ModbusBits,
+				BitCount:   8,
+				Endianness: EndiannessMixedEndian,
+				MetricType: MetricTypeGauge,
+			},
+			fmt.Errorf("invalid endianness definition alarm: bits data type has no byte order"),
+		},
+		{
+			"big endianness of coil",
+			MetricDef{
+				Address:    100001,
+				DataType:   ModbusBool,
+				Endianness: EndiannessBigEndian,
+				MetricType: MetricTypeGauge,
+			},
+			nil,
+		},
+		{
+			"register order of string",
+			MetricDef{
+				Name:          "serial",
+				Address:       300001,
+				DataType:      ModbusString,
+				Length:        4,
+				RegisterOrder: OrderLittle,
+				MetricType:    MetricTypeGauge,
+			},
+			fmt.Errorf("invalid endianness definition serial: registerOrder can only be used with 64 bit data types"),
+		},
+		{
+			"register order of 64 bit uint",
+			MetricDef{
+				DataType:      ModbusUInt,
+				Length:        4,
+				RegisterOrder: OrderLittle,
+				MetricType:    MetricTypeGauge,
+			},
+			nil,
+		},
+		{
+			"invalid byte order",
+			MetricDef{
+				Name:       "power",
+				DataType:   ModbusUInt32,
+				ByteOrder:  "middle",
+				MetricType: MetricTypeGauge,
+			},
+			fmt.Errorf("invalid endianness definition power: expected byteOrder to be one of big, little but got 'middle'"),
+		},
+		{
+			"sign magnitude",
+			MetricDef{
+				DataType:   ModbusInt16,
+				Encoding:   EncodingSignMagnitude,
+				MetricType: MetricTypeGauge,
+			},
+			nil,
+		},
+		{
+			"ones complement of unsigned",
+			MetricDef{
+				Name:       "temperature",
+				DataType:   ModbusUInt16,
+				Encoding:   EncodingOnesComplement,
+				MetricType: MetricTypeGauge,
+			},
+			fmt.Errorf("invalid metric definition temperature: encoding can only be used with signed integer data types"),
+		},
+		{
+			"bit field of float",
+			MetricDef{
+				Name:       "state",
+				DataType:   ModbusFloat32,
+				BitLength:  4,
+				MetricType: MetricTypeGauge,
+			},
+			fmt.Errorf("invalid metric definition state: bitLength can only be used with integer data types"),
+		},
+		{
+			"scale factor",
+			MetricDef{
+				Name:               "power",
+				Address:            340083,
+				DataType:           ModbusInt16,
+				ScaleFactorAddress: 340084,
+				MetricType:         MetricTypeGauge,
+			},
+			nil,
+		},
+		{
+			"scale factor of coil",
+			MetricDef{
+				Name:               "power",
+				Address:            340083,
+				DataType:           ModbusInt16,
+				ScaleFactorAddress: 100084,
+				MetricType:         MetricTypeGauge,
+			},
+			fmt.Errorf("invalid metric definition power: expected scaleFactorAddress to be a holding or input register but got 100084"),
+		},
+		{
+			"scale factor of string",
+			MetricDef{
+				Name:               "serial",
+				Address:            340083,
+				DataType:           ModbusString,
+				Length:             8,
+				ScaleFactorAddress: 340084,
+				MetricType:         MetricTypeGauge,
+			},
+			fmt.Errorf("invalid metric definition serial: scaleFactorAddress cannot be used with string data type"),
+		},
+		{
+			"offset",
+			MetricDef{
+				Name:       "temperature",
+				DataType:   ModbusInt16,
+				Offset:     &negativeOffset,
+				MetricType: MetricTypeGauge,
+			},
+			nil,
+		},
+		{
+			"offset of bool",
+			MetricDef{
+				Name:       "coil",
+				Address:    100001,
+				DataType:   ModbusBool,
+				Offset:     &negativeOffset,
+				MetricType: MetricTypeGauge,
+			},
+			fmt.Errorf("offset cannot be used with bool data type"),
+		},
+		{
+			"transform",
+			MetricDef{
+				Name:       "level",
+				DataType:   ModbusUInt16,
+				Transform:  &Transform{PreOffset: -4000, Divisor: &divisor, PostOffset: 1},
+				MetricType: MetricTypeGauge,
+			},
+			nil,
+		},
+		{
+			"transform with factor",
+			MetricDef{
+				Name:       "level",
+				DataType:   ModbusUInt16,
+				Factor:     &divisor,
+				Transform:  &Transform{PreOffset: -4000},
+				MetricType: MetricTypeGauge,
+			},
+			fmt.Errorf("invalid metric definition level: transform cannot be combined with factor or offset"),
+		},
+		{
+			"transform divisor 0",
+			MetricDef{
+				Name:       "level",
+				DataType:   ModbusUInt16,
+				Transform:  &Transform{Divisor: &zero},
+				MetricType: MetricTypeGauge,
+			},
+			fmt.Errorf("invalid metric definition level: transform divisor cannot be 0"),
+		},
+		{
+			"invalid values",
+			MetricDef{
+				Name:          "temperature",
+				DataType:      ModbusInt16,
+				InvalidValues: []float64{-32768},
+				ValidRange:    &ValueRange{Min: &negativeOffset},
+				MetricType:    MetricTypeGauge,
+			},
+			nil,
+		},
+		{
+			"empty valid range",
+			MetricDef{
+				Name:       "temperature",
+				DataType:   ModbusInt16,
+				ValidRange: &ValueRange{},
+				MetricType: MetricTypeGauge,
+			},
+			fmt.Errorf("invalid metric definition temperature: expected validRange to have min or max"),
+		},
+		{
+			"reversed valid range",
+			MetricDef{
+				Name:       "temperature",
+				DataType:   ModbusInt16,
+				ValidRange: &ValueRange{Min: &divisor, Max: &zero},
+				MetricType: MetricTypeGauge,
+			},
+			fmt.Errorf("invalid metric definition temperature: expected min 16000 of validRange to be at most max 0"),
+		},
+		{
+			"enum",
+			MetricDef{
+				Name:        "mode",
+				DataType:    ModbusUInt16,
+				Enum:        map[int64]string{0: "off", 1: "standby", 2: "running"},
+				EnumUnknown: "other",
+				MetricType:  MetricTypeGauge,
+			},
+			nil,
+		},
+		{
+			"enum with duplicate state",
+			MetricDef{
+				Name:       "mode",
+				DataType:   ModbusUInt16,
+				Enum:       map[int64]string{0: "off", 1: "unknown"},
+				MetricType: MetricTypeGauge,
+			},
+			fmt.Errorf("invalid metric definition mode: enum state unknown is not unique"),
+		},
+		{
+			"enum with factor",
+			MetricDef{
+				Name:       "mode",
+				DataType:   ModbusUInt16,
+				Enum:       map[int64]string{0: "off"},
+				Factor:     &divisor,
+				MetricType: MetricTypeGauge,
+			},
+			fmt.Errorf("invalid metric definition mode: enum cannot be combined with factor, offset, transform, scaleFactorAddress, calibration or expr"),
+		},
+		{
+			"enum as counter",
+			MetricDef{
+				Name:       "mode",
+				DataType:   ModbusUInt16,
+				Enum:       map[int64]string{0: "off"},
+				MetricType: MetricTypeCounter,
+			},
+			fmt.Errorf("invalid metric definition mode: enums can only be exported as gauge"),
+		},
+		{
+			"enum with state label",
+			MetricDef{
+				Name:       "mode",
+				DataType:   ModbusUInt16,
+				Labels:     map[string]string{"state": "x"},
+				Enum:       map[int64]string{0: "off"},
+				MetricType: MetricTypeGauge,
+			},
+			fmt.Errorf("invalid metric definition mode: label state is reserved for the state of the enum"),
+		},
+		{
+			"enumUnknown without enum",
+			MetricDef{
+				Name:        "mode",
+				DataType:    ModbusUInt16,
+				EnumUnknown: "other",
+				MetricType:  MetricTypeGauge,
+			},
+			fmt.Errorf("invalid metric definition mode: enumUnknown can only be used together with enum"),
+		},
+		{
+			"calibration",
+			MetricDef{
+				Name:                  "level",
+				DataType:              ModbusUInt16,
+				Calibration:           []CalibrationPoint{{Raw: 0, Value: 1000}, {Raw: 4095, Value: 0}},
+				CalibrationOutOfRange: OutOfRangeExtrapolate,
+				MetricType:            MetricTypeGauge,
+			},
+			nil,
+		},
+		{
+			"calibration with single point",
+			MetricDef{
+				Name:        "level",
+				DataType:    ModbusUInt16,
+				Calibration: []CalibrationPoint{{Raw: 0, Value: 1000}},
+				MetricType:  MetricTypeGauge,
+			},
+			fmt.Errorf("invalid metric definition level: expected calibration to have at least 2 points but got 1"),
+		},
+		{
+			"calibration not increasing",
+			MetricDef{
+				Name:        "level",
+				DataType:    ModbusUInt16,
+				Calibration: []CalibrationPoint{{Raw: 0, Value: 0}, {Raw: 200, Value: 1}, {Raw: 200, Value: 2}},
+				MetricType:  MetricTypeGauge,
+			},
+			fmt.Errorf("invalid metric definition level: expected raw values of calibration to be strictly increasing but got 200 after 200"),
+		},
+		{
+			"calibration out of range without table",
+			MetricDef{
+				Name:                  "level",
+				DataType:              ModbusUInt16,
+				CalibrationOutOfRange: OutOfRangeDrop,
+				MetricType:            MetricTypeGauge,
+			},
+			fmt.Errorf("invalid metric definition level: expected calibration to have at least 2 points but got 0"),
+		},
+		{
+			"calibration invalid out of range",
+			MetricDef{
+				Name:                  "level",
+				DataType:              ModbusUInt16,
+				Calibration:           []CalibrationPoint{{Raw: 0, Value: 0}, {Raw: 200, Value: 1}},
+				CalibrationOutOfRange: "wrap",
+				MetricType:            MetricTypeGauge,
+			},
+			fmt.Errorf("invalid metric definition level: expected calibrationOutOfRange to be one of clamp, extrapolate, drop but got 'wrap'"),
 		},
 	} {
 		err := test.metricDef.validate()
@@ -72,3 +636,386 @@ func TestModuleValidate(t *testing.T) {
 		t.Fatal("expected validation to fail with invalid modbus protocol")
 	}
 }
+
+func TestModuleValidateSerial(t *testing.T) {
+	m := Module{
+		Protocol: ModbusProtocolRTU,
+		Metrics: []MetricDef{
+			{
+				DataType:   ModbusInt16,
+				MetricType: MetricTypeGauge,
+			},
+		},
+	}
+
+	if err := m.validate(); err != nil {
+		t.Fatalf("expected default serial settings to be valid but got: %v", err)
+	}
+
+	m.Parity = "X"
+	if err := m.validate(); err == nil {
+		t.Fatal("expected validation to fail with invalid parity")
+	}
+
+	m.Parity = "N"
+	m.Databits = 9
+	if err := m.validate(); err == nil {
+		t.Fatal("expected validation to fail with invalid databits")
+	}
+}
+
+func TestModuleValidateTLS(t *testing.T) {
+	m := Module{
+		Protocol: ModbusProtocolTCPTLS,
+		Metrics: []MetricDef{
+			{
+				DataType:   ModbusInt16,
+				MetricType: MetricTypeGauge,
+			},
+		},
+	}
+
+	if err := m.validate(); err == nil {
+		t.Fatal("expected validation to fail without client certificate")
+	}
+
+	m.TLS = TLSConfig{CertFile: "client.crt", KeyFile: "client.key"}
+	if err := m.validate(); err != nil {
+		t.Fatalf("expected validation to pass but got: %v", err)
+	}
+}
+
+func TestModuleValidatePlanner(t *testing.T) {
+	m := Module{
+		Protocol:               ModbusProtocolTCPIP,
+		MaxGap:                 10,
+		MaxRegistersPerRequest: 64,
+		ForbiddenRanges:        []AddressRange{{From: 300100, To: 300199}},
+		Metrics: []MetricDef{
+			{
+				DataType:   ModbusInt16,
+				MetricType: MetricTypeGauge,
+			},
+		},
+	}
+
+	if err := m.validate(); err != nil {
+		t.Fatalf("expected validation to pass but got: %v", err)
+	}
+
+	m.MaxRegistersPerRequest = 126
+	if err := m.validate(); err == nil {
+		t.Fatal("expected validation to fail with maxRegistersPerRequest above the protocol limit")
+	}
+
+	m.MaxRegistersPerRequest = 0
+	m.ForbiddenRanges = []AddressRange{{From: 300199, To: 300100}}
+	if err := m.validate(); err == nil {
+		t.Fatal("expected validation to fail with reversed forbidden range")
+	}
+
+	m.ForbiddenRanges = []AddressRange{{From: 300100, To: 400199}}
+	if err := m.validate(); err == nil {
+		t.Fatal("expected validation to fail with forbidden range spanning function codes")
+	}
+}
+
+func TestModuleValidateRequests(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		module   Module
+		expected string
+	}{
+		{
+			"metric within forbidden range",
+			Module{
+				ForbiddenRanges: []AddressRange{{From: 300012, To: 300020}},
+				Metrics:         []MetricDef{{Name: "energy", Address: 300010, DataType: ModbusUInt64, MetricType: MetricTypeCounter}},
+			},
+			"metric energy in module test: address 300010 is within a forbidden range",
+		},
+		{
+			"forbidden range of other function code",
+			Module{
+				ForbiddenRanges: []AddressRange{{From: 400012, To: 400020}},
+				Metrics:         []MetricDef{{Name: "energy", Address: 300010, DataType: ModbusUInt64, MetricType: MetricTypeCounter}},
+			},
+			"",
+		},
+		{
+			"scale factor within forbidden range",
+			Module{
+				ForbiddenRanges: []AddressRange{{From: 300012, To: 300020}},
+				Metrics: []MetricDef{
+					{Name: "power", Address: 300010, DataType: ModbusInt16, ScaleFactorAddress: 300015, MetricType: MetricTypeGauge},
+				},
+			},
+			"metric power in module test: scale factor address 300015 is within a forbidden range",
+		},
+		{
+			"metric exceeding maxRegistersPerRequest",
+			Module{
+				MaxRegistersPerRequest: 2,
+				Metrics: []MetricDef{
+					{Name: "serial", Address: 300010, DataType: ModbusString, Length: 8, MetricType: MetricTypeGauge},
+				},
+			},
+			"metric serial in module test needs 8 registers, more than the 2 allowed per request",
+		},
+		{
+			"maxRegistersPerRequest does not limit bits",
+			Module{
+				MaxRegistersPerRequest: 2,
+				Metrics: []MetricDef{
+					{Name: "alarm", Address: 100010, DataType: ModbusBits, BitCount: 16, MetricType: MetricTypeGauge},
+				},
+			},
+			"",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			m := test.module
+			m.Name = "test"
+			m.Protocol = ModbusProtocolTCPIP
+
+			err := m.validate()
+			if test.expected == "" {
+				if err != nil {
+					t.Fatalf("expected validation to pass but got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.expected) {
+				t.Fatalf("expected error '%v' but got: %v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestModuleValidateInvalidValuePolicy(t *testing.T) {
+	m := Module{
+		Protocol:           ModbusProtocolTCPIP,
+		InvalidValuePolicy: InvalidValueNaN,
+		Metrics: []MetricDef{
+			{
+				DataType:   ModbusInt16,
+				MetricType: MetricTypeGauge,
+			},
+		},
+	}
+
+	if err := m.validate(); err != nil {
+		t.Fatalf("expected validation to pass but got: %v", err)
+	}
+
+	m.InvalidValuePolicy = "zero"
+	if err := m.validate(); err == nil {
+		t.Fatal("expected validation to fail with unknown invalidValuePolicy")
+	}
+}
+
+func TestModuleValidateExpressions(t *testing.T) {
+	metric := func(name string, dataType ModbusDataType, expr string) MetricDef {
+		d := MetricDef{Name: name, Address: 300001, DataType: dataType, Expr: expr, MetricType: MetricTypeGauge}
+		if dataType == ModbusString {
+			d.Length = 4
+		}
+		return d
+	}
+
+	for _, test := range []struct {
+		name     string
+		metrics  []MetricDef
+		expected string
+	}{
+		{
+			"valid",
+			[]MetricDef{
+				metric("active", ModbusInt16, ""),
+				metric("apparent", ModbusInt16, "sqrt(active^2 + x^2)"),
+				metric("temperature", ModbusInt16, "x + raw / 100"),
+			},
+			"",
+		},
+		{
+			"syntax error",
+			[]MetricDef{metric("temperature", ModbusInt16, "(x - 32) * 5 /")},
+			"failed to validate module test: invalid metric definition temperature: expr: unexpected 'end of expression' at position 14",
+		},
+		{
+			"unknown metric",
+			[]MetricDef{metric("apparent", ModbusInt16, "sqrt(activ^2 + x^2)")},
+			"expr of metric apparent in module test references unknown metric activ",
+		},
+		{
+			"ambiguous metric",
+			[]MetricDef{
+				metric("power", ModbusInt16, ""),
+				metric("power", ModbusInt16, ""),
+				metric("total", ModbusInt16, "power * 3"),
+			},
+			"expr of metric total in module test references ambiguous metric power",
+		},
+		{
+			"string metric",
+			[]MetricDef{
+				metric("serial", ModbusString, ""),
+				metric("total", ModbusInt16, "serial"),
+			},
+			"expr of metric total in module test references metric serial without a single value",
+		},
+		{
+			"enum metric",
+			[]MetricDef{
+				{Name: "mode", Address: 300001, DataType: ModbusUInt16, Enum: map[int64]string{0: "off"}, MetricType: MetricTypeGauge},
+				metric("total", ModbusInt16, "mode"),
+			},
+			"expr of metric total in module test references metric mode without a single value",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			m := Module{Name: "test", Protocol: ModbusProtocolTCPIP, Metrics: test.metrics}
+
+			err := m.validate()
+			if test.expected == "" {
+				if err != nil {
+					t.Fatalf("expected validation to pass but got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.expected) {
+				t.Fatalf("expected error '%v' but got: %v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestModuleValidateDerived(t *testing.T) {
+	metrics := []MetricDef{
+		{Name: "power_l1", Address: 300001, DataType: ModbusInt16, MetricType: MetricTypeGauge},
+		{Name: "power_l2", Address: 300002, DataType: ModbusInt16, MetricType: MetricTypeGauge},
+		{Name: "apparent_power", Address: 300003, DataType: ModbusInt16, MetricType: MetricTypeGauge},
+	}
+	derived := func(name, expr string) DerivedMetricDef {
+		return DerivedMetricDef{Name: name, Expr: expr, MetricType: MetricTypeGauge}
+	}
+
+	for _, test := range []struct {
+		name     string
+		derived  []DerivedMetricDef
+		expected string
+	}{
+		{
+			"valid",
+			[]DerivedMetricDef{
+				derived("power_factor", "power_total / apparent_power"),
+				derived("power_total", "power_l1 + power_l2"),
+			},
+			"",
+		},
+		{
+			"unknown metric",
+			[]DerivedMetricDef{derived("power_total", "power_l1 + power_l3")},
+			"derived metric power_total in module test references unknown metric power_l3",
+		},
+		{
+			"value of metric",
+			[]DerivedMetricDef{derived("power_total", "x")},
+			"derived metric power_total in module test references unknown metric x",
+		},
+		{
+			"without metric type",
+			[]DerivedMetricDef{{Name: "power_total", Expr: "power_l1"}},
+			"invalid derived metric power_total in module test: expected one of the following metric types [gauge counter] but got ''",
+		},
+		{
+			"name of metric",
+			[]DerivedMetricDef{derived("power_l1", "power_l2 * 2")},
+			"derived metric power_l1 in module test has the same name as another metric",
+		},
+		{
+			"name of derived metric",
+			[]DerivedMetricDef{
+				derived("power_total", "power_l1 + power_l2"),
+				derived("power_total", "power_l1"),
+			},
+			"derived metric power_total in module test has the same name as another metric",
+		},
+		{
+			"self reference",
+			[]DerivedMetricDef{derived("energy", "energy + power_l1")},
+			"invalid derived metrics in module test: dependency cycle energy -> energy",
+		},
+		{
+			"cycle",
+			[]DerivedMetricDef{
+				derived("a", "power_l1 + c"),
+				derived("b", "a * 2"),
+				derived("c", "b / 2"),
+			},
+			"invalid derived metrics in module test: dependency cycle a -> c -> b -> a",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			m := Module{Name: "test", Protocol: ModbusProtocolTCPIP, Metrics: metrics, Derived: test.derived}
+
+			err := m.validate()
+			if test.expected == "" {
+				if err != nil {
+					t.Fatalf("expected validation to pass but got: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.expected) {
+				t.Fatalf("expected error '%v' but got: %v", test.expected, err)
+			}
+		})
+	}
+}
+
+func TestModuleDerivedOrder(t *testing.T) {
+	m := Module{
+		Derived: []DerivedMetricDef{
+			{Name: "power_factor", Expr: "power_total / apparent_power"},
+			{Name: "power_total", Expr: "power_l1 + power_l2"},
+			{Name: "power_total_kw", Expr: "power_total / 1000"},
+		},
+	}
+
+	order, err := m.DerivedOrder()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(order) != "[1 0 2]" {
+		t.Fatalf("expected order [1 0 2] but got %v", order)
+	}
+}
+
+func TestRegisterAddrParse(t *testing.T) {
+	for _, test := range []struct {
+		address  RegisterAddr
+		function uint8
+		register uint16
+	}{
+		{300022, 3, 22},
+		{30022, 3, 22},
+		{10, 1, 0},
+		{465535, 4, 65535},
+	} {
+		function, register, err := test.address.Parse()
+		if err != nil {
+			t.Errorf("%v: %v", test.address, err)
+			continue
+		}
+		if function != test.function || register != test.register {
+			t.Errorf("expected %v to be function %v, register %v but got %v, %v",
+				test.address, test.function, test.register, function, register)
+		}
+	}
+
+	for _, address := range []RegisterAddr{3, 500001, 465536} {
+		if _, _, err := address.Parse(); err == nil {
+			t.Errorf("expected %v to be invalid", address)
+		}
+	}
+}
@@ -0,0 +1,421 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Limits keeping expressions small, as they are evaluated on every scrape.
+const (
+	maxExprLength = 1024
+	maxExprDepth  = 64
+)
+
+// ExprValueVariable is the name of the variable holding the value of the
+// metric an expression belongs to.
+const ExprValueVariable = "x"
+
+// ExprRawVariable is the name of the variable holding the decoded value of the
+// metric an expression belongs to, before factor, offset, transform, scale
+// factor and calibration are applied.
+const ExprRawVariable = "raw"
+
+// Expr is a parsed arithmetic expression over float64 values. It supports
+// numbers, variables, the operators + - * / % ^, parentheses and the
+// functions listed in exprFunctions. Expressions have no access to anything
+// but the variables passed to Eval.
+type Expr struct {
+	root      exprNode
+	variables []string
+}
+
+// exprFunction is a function callable from expressions. An arity of -1
+// accepts one or more arguments.
+type exprFunction struct {
+	arity int
+	call  func(args []float64) float64
+}
+
+var exprFunctions = map[string]exprFunction{
+	"abs":   {1, func(a []float64) float64 { return math.Abs(a[0]) }},
+	"sqrt":  {1, func(a []float64) float64 { return math.Sqrt(a[0]) }},
+	"exp":   {1, func(a []float64) float64 { return math.Exp(a[0]) }},
+	"log":   {1, func(a []float64) float64 { return math.Log(a[0]) }},
+	"log10": {1, func(a []float64) float64 { return math.Log10(a[0]) }},
+	"floor": {1, func(a []float64) float64 { return math.Floor(a[0]) }},
+	"ceil":  {1, func(a []float64) float64 { return math.Ceil(a[0]) }},
+	"round": {1, func(a []float64) float64 { return math.Round(a[0]) }},
+	"pow":   {2, func(a []float64) float64 { return math.Pow(a[0], a[1]) }},
+	"min": {-1, func(a []float64) float64 {
+		v := a[0]
+		for _, x := range a[1:] {
+			v = math.Min(v, x)
+		}
+		return v
+	}},
+	"max": {-1, func(a []float64) float64 {
+		v := a[0]
+		for _, x := range a[1:] {
+			v = math.Max(v, x)
+		}
+		return v
+	}},
+}
+
+// ParseExpr parses the given expression and checks the number of arguments of
+// all function calls.
+func ParseExpr(s string) (*Expr, error) {
+	if len(s) > maxExprLength {
+		return nil, fmt.Errorf("expression longer than %v characters", maxExprLength)
+	}
+
+	tokens, err := tokenizeExpr(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &exprParser{tokens: tokens, variables: map[string]bool{}}
+	root, err := p.parseSum(0)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEnd {
+		return nil, fmt.Errorf("unexpected '%v' at position %v", t.text, t.pos)
+	}
+
+	variables := make([]string, 0, len(p.variables))
+	for v := range p.variables {
+		variables = append(variables, v)
+	}
+	sort.Strings(variables)
+
+	return &Expr{root: root, variables: variables}, nil
+}
+
+// Variables returns the names of the variables used by the expression.
+func (e *Expr) Variables() []string {
+	return e.variables
+}
+
+// Eval evaluates the expression. It fails if a variable is missing.
+func (e *Expr) Eval(variables map[string]float64) (float64, error) {
+	return e.root.eval(variables)
+}
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenNumber
+	tokenIdent
+	tokenOperator
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func tokenizeExpr(s string) ([]token, error) {
+	tokens := []token{}
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case strings.IndexByte("+-*/%^(),", c) >= 0:
+			tokens = append(tokens, token{tokenOperator, string(c), i})
+			i++
+		case c >= '0' && c <= '9' || c == '.':
+			start := i
+			for i < len(s) && (s[i] >= '0' && s[i] <= '9' || s[i] == '.') {
+				i++
+			}
+			// Exponent, e.g. 1e-3.
+			if i < len(s) && (s[i] == 'e' || s[i] == 'E') {
+				i++
+				if i < len(s) && (s[i] == '+' || s[i] == '-') {
+					i++
+				}
+				for i < len(s) && s[i] >= '0' && s[i] <= '9' {
+					i++
+				}
+			}
+			tokens = append(tokens, token{tokenNumber, s[start:i], start})
+		case isIdentStart(c):
+			start := i
+			for i < len(s) && (isIdentStart(s[i]) || s[i] >= '0' && s[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, token{tokenIdent, s[start:i], start})
+		default:
+			return nil, fmt.Errorf("unexpected character '%c' at position %v", c, i)
+		}
+	}
+
+	return append(tokens, token{tokenEnd, "end of expression", len(s)}), nil
+}
+
+// isIdentStart returns whether c can start an identifier. Identifiers follow
+// the Prometheus metric name syntax.
+func isIdentStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_' || c == ':'
+}
+
+// exprParser is a recursive descent parser with the usual precedence: ^
+// binds tighter than unary minus, which binds tighter than * / %, which bind
+// tighter than + -. ^ is right associative, all others left associative.
+type exprParser struct {
+	tokens    []token
+	pos       int
+	variables map[string]bool
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEnd {
+		p.pos++
+	}
+	return t
+}
+
+func (p *exprParser) isOperator(ops string) bool {
+	t := p.peek()
+	return t.kind == tokenOperator && strings.Contains(ops, t.text)
+}
+
+func (p *exprParser) expect(op string) error {
+	if t := p.next(); t.kind != tokenOperator || t.text != op {
+		return fmt.Errorf("expected '%v' but got '%v' at position %v", op, t.text, t.pos)
+	}
+	return nil
+}
+
+func (p *exprParser) parseSum(depth int) (exprNode, error) {
+	left, err := p.parseProduct(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.isOperator("+-") {
+		op := p.next().text
+		right, err := p.parseProduct(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op[0], left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseProduct(depth int) (exprNode, error) {
+	left, err := p.parseUnary(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.isOperator("*/%") {
+		op := p.next().text
+		right, err := p.parseUnary(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = &binaryNode{op[0], left, right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseUnary(depth int) (exprNode, error) {
+	if depth > maxExprDepth {
+		return nil, fmt.Errorf("expression nested deeper than %v levels", maxExprDepth)
+	}
+
+	if p.isOperator("+-") {
+		op := p.next().text
+		operand, err := p.parseUnary(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		if op == "+" {
+			return operand, nil
+		}
+		return &negateNode{operand}, nil
+	}
+
+	return p.parsePower(depth)
+}
+
+func (p *exprParser) parsePower(depth int) (exprNode, error) {
+	base, err := p.parsePrimary(depth)
+	if err != nil {
+		return nil, err
+	}
+	if !p.isOperator("^") {
+		return base, nil
+	}
+	p.next()
+	exponent, err := p.parseUnary(depth + 1)
+	if err != nil {
+		return nil, err
+	}
+	return &binaryNode{'^', base, exponent}, nil
+}
+
+func (p *exprParser) parsePrimary(depth int) (exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenNumber:
+		v, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number '%v' at position %v", t.text, t.pos)
+		}
+		return numberNode(v), nil
+	case tokenIdent:
+		f, isFunction := exprFunctions[t.text]
+		if !p.isOperator("(") {
+			if isFunction {
+				return nil, fmt.Errorf("expected arguments of function %v at position %v", t.text, t.pos)
+			}
+			p.variables[t.text] = true
+			return variableNode(t.text), nil
+		}
+		if !isFunction {
+			return nil, fmt.Errorf("unknown function %v at position %v", t.text, t.pos)
+		}
+		p.next()
+
+		args := []exprNode{}
+		for !p.isOperator(")") {
+			if len(args) > 0 {
+				if err := p.expect(","); err != nil {
+					return nil, err
+				}
+			}
+			arg, err := p.parseSum(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+		}
+		p.next()
+
+		if f.arity == -1 && len(args) == 0 || f.arity >= 0 && len(args) != f.arity {
+			expected := strconv.Itoa(f.arity)
+			if f.arity == -1 {
+				expected = "at least 1"
+			}
+			return nil, fmt.Errorf("function %v expects %v arguments but got %v at position %v",
+				t.text, expected, len(args), t.pos)
+		}
+		return &callNode{f, args}, nil
+	case tokenOperator:
+		if t.text == "(" {
+			n, err := p.parseSum(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return n, nil
+		}
+	}
+
+	return nil, fmt.Errorf("unexpected '%v' at position %v", t.text, t.pos)
+}
+
+type exprNode interface {
+	eval(variables map[string]float64) (float64, error)
+}
+
+type numberNode float64
+
+func (n numberNode) eval(map[string]float64) (float64, error) {
+	return float64(n), nil
+}
+
+type variableNode string
+
+func (n variableNode) eval(variables map[string]float64) (float64, error) {
+	v, ok := variables[string(n)]
+	if !ok {
+		return 0, fmt.Errorf("missing value of %v", string(n))
+	}
+	return v, nil
+}
+
+type negateNode struct {
+	operand exprNode
+}
+
+func (n *negateNode) eval(variables map[string]float64) (float64, error) {
+	v, err := n.operand.eval(variables)
+	return -v, err
+}
+
+type binaryNode struct {
+	op          byte
+	left, right exprNode
+}
+
+func (n *binaryNode) eval(variables map[string]float64) (float64, error) {
+	l, err := n.left.eval(variables)
+	if err != nil {
+		return 0, err
+	}
+	r, err := n.right.eval(variables)
+	if err != nil {
+		return 0, err
+	}
+
+	switch n.op {
+	case '+':
+		return l + r, nil
+	case '-':
+		return l - r, nil
+	case '*':
+		return l * r, nil
+	case '/':
+		return l / r, nil
+	case '%':
+		return math.Mod(l, r), nil
+	default:
+		return math.Pow(l, r), nil
+	}
+}
+
+type callNode struct {
+	function exprFunction
+	args     []exprNode
+}
+
+func (n *callNode) eval(variables map[string]float64) (float64, error) {
+	args := make([]float64, len(n.args))
+	for i, arg := range n.args {
+		v, err := arg.eval(variables)
+		if err != nil {
+			return 0, err
+		}
+		args[i] = v
+	}
+	return n.function.call(args), nil
+}
@@ -0,0 +1,100 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestParseExpr(t *testing.T) {
+	variables := map[string]float64{"x": 212, "p": 3, "q": 4, "power:total": 10}
+
+	for _, test := range []struct {
+		expr     string
+		expected float64
+	}{
+		{"x", 212},
+		{"(x - 32) * 5 / 9", 100},
+		{"sqrt(p^2 + q^2)", 5},
+		{"1 + 2 * 3", 7},
+		{"(1 + 2) * 3", 9},
+		{"2 ^ 3 ^ 2", 512},
+		{"-2 ^ 2", -4},
+		{"--p", 3},
+		{"7 % 4", 3},
+		{"1e3 / .5", 2000},
+		{"min(p, q, 1) + max(p, q)", 5},
+		{"pow(2, 10) + abs(-1) + floor(1.5) + ceil(1.5) + round(2.5)", 1031},
+		{"power:total / 2", 5},
+	} {
+		t.Run(test.expr, func(t *testing.T) {
+			expr, err := ParseExpr(test.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			v, err := expr.Eval(variables)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v != test.expected {
+				t.Fatalf("expected %v but got %v", test.expected, v)
+			}
+		})
+	}
+}
+
+func TestParseExprVariables(t *testing.T) {
+	expr, err := ParseExpr("sqrt(x^2 + reactive^2) / x")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := fmt.Sprint(expr.Variables()); got != "[reactive x]" {
+		t.Fatalf("expected variables [reactive x] but got %v", got)
+	}
+
+	if _, err := expr.Eval(map[string]float64{"x": 1}); err == nil {
+		t.Fatal("expected evaluation without reactive to fail")
+	}
+}
+
+func TestParseExprErrors(t *testing.T) {
+	for expr, expected := range map[string]string{
+		"":           "unexpected 'end of expression' at position 0",
+		"x +":        "unexpected 'end of expression' at position 3",
+		"(x":         "expected ')' but got 'end of expression' at position 2",
+		"x)":         "unexpected ')' at position 1",
+		"x $ 2":      "unexpected character '$' at position 2",
+		"system(x)":  "unknown function system at position 0",
+		"sqrt":       "expected arguments of function sqrt at position 0",
+		"sqrt(x, 2)": "function sqrt expects 1 arguments but got 2 at position 0",
+		"max()":      "function max expects at least 1 arguments but got 0 at position 0",
+		"1..2":       "invalid number '1..2' at position 0",
+		strings.Repeat("(", 100) + "x" + strings.Repeat(")", 100): "expression nested deeper than 64 levels",
+		strings.Repeat("x+", 600) + "x":                           "expression longer than 1024 characters",
+	} {
+		t.Run(expr, func(t *testing.T) {
+			_, err := ParseExpr(expr)
+			if err == nil {
+				t.Fatal("expected parsing to fail")
+			}
+			if err.Error() != expected {
+				t.Fatalf("expected error '%v' but got '%v'", expected, err)
+			}
+		})
+	}
+}
@@ -6,6 +6,7 @@ require (
 	github.com/alecthomas/kingpin/v2 v2.3.2
 	github.com/go-kit/log v0.2.1
 	github.com/goburrow/modbus v0.0.0-20161010020032-f7afd8db7d8d
+	github.com/goburrow/serial v0.0.0-20170301104454-d490ecc9d6a1
 	github.com/hashicorp/go-multierror v0.0.0-20161216184304-ed905158d874
 	github.com/prometheus/client_golang v1.14.0
 	github.com/prometheus/common v0.41.0
@@ -20,7 +21,6 @@ require (
 	github.com/cespare/xxhash/v2 v2.1.2 // indirect
 	github.com/coreos/go-systemd/v22 v22.5.0 // indirect
 	github.com/go-logfmt/logfmt v0.5.1 // indirect
-	github.com/goburrow/serial v0.0.0-20170301104454-d490ecc9d6a1 // indirect
 	github.com/golang/protobuf v1.5.2 // indirect
 	github.com/hashicorp/errwrap v0.0.0-20141028054710-7554cd9344ce // indirect
 	github.com/jpillora/backoff v1.0.0 // indirect
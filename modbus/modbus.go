@@ -14,12 +14,17 @@
 package modbus
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"math"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 
+	"github.com/go-kit/log"
 	"github.com/prometheus/client_golang/prometheus"
 
 	"github.com/RichiH/modbus_exporter/config"
@@ -27,14 +32,46 @@ import (
 )
 
 // Exporter represents a Prometheus exporter converting modbus information
-// retrieved from remote targets via TCP as Prometheus style metrics.
+// retrieved from remote targets via TCP or serial lines as Prometheus style
+// metrics.
 type Exporter struct {
-	Config config.Config
+	Config    config.Config
+	logger    log.Logger
+	pool      *connectionPool
+	scheduler *requestScheduler
+	// suppressed counts readings marked as invalid per module and metric.
+	suppressed *prometheus.CounterVec
 }
 
+// defaultIdleTimeout is used if the module does not specify an idle timeout.
+const defaultIdleTimeout = 30 * time.Second
+
 // NewExporter returns a new modbus exporter.
-func NewExporter(config config.Config) *Exporter {
-	return &Exporter{config}
+func NewExporter(config config.Config, logger log.Logger) *Exporter {
+	return &Exporter{
+		Config:    config,
+		logger:    logger,
+		pool:      newConnectionPool(),
+		scheduler: newRequestScheduler(),
+		suppressed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "modbus_suppressed_samples_total",
+			Help: "Number of readings matching the invalid values or outside of the valid range of their metric.",
+		}, []string{"module", "metric"}),
+	}
+}
+
+// Describe implements the prometheus.Collector interface for the metrics of
+// the exporter itself.
+func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
+	e.scheduler.Describe(ch)
+	e.suppressed.Describe(ch)
+}
+
+// Collect implements the prometheus.Collector interface for the metrics of
+// the exporter itself.
+func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
+	e.scheduler.Collect(ch)
+	e.suppressed.Collect(ch)
 }
 
 // GetConfig loads the config file
@@ -42,8 +79,8 @@ func (e *Exporter) GetConfig() *config.Config {
 	return &e.Config
 }
 
-// Scrape scrapes the given target via TCP based on the configuration of the
-// specified module returning a Prometheus gatherer with the resulting metrics.
+// Scrape scrapes the given target via the protocol of the specified module
+// returning a Prometheus gatherer with the resulting metrics.
 func (e *Exporter) Scrape(targetAddress string, subTarget byte, moduleName string) (prometheus.Gatherer, error) {
 	reg := prometheus.NewRegistry()
 
@@ -52,32 +89,50 @@ func (e *Exporter) Scrape(targetAddress string, subTarget byte, moduleName strin
 		return nil, fmt.Errorf("failed to find '%v' in config", moduleName)
 	}
 
-	// TODO: We should probably be reusing these, right?
-	handler := modbus.NewTCPClientHandler(targetAddress)
-	if module.Timeout != 0 {
-		handler.Timeout = time.Duration(module.Timeout) * time.Millisecond
+	timeout := time.Duration(module.Timeout) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultTimeout
 	}
-	handler.SlaveId = subTarget
-	if err := handler.Connect(); err != nil {
-		return nil, fmt.Errorf("unable to connect with target %s via module %s",
-			targetAddress, module.Name)
+
+	// Connections are shared by all modules and sub targets scraping the
+	// same target via the same protocol and transport settings, one scrape
+	// at a time.
+	waited := e.scheduler.track(targetAddress)
+	conn, fresh, err := e.pool.get(connectionKey(module, targetAddress), timeout, func() (transporter, error) {
+		return newTransporter(module, targetAddress, e.logger)
+	})
+	waited()
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect with target %s via module %s: %v",
+			targetAddress, module.Name, err)
 	}
 
-	if module.Workarounds.SleepAfterConnect > 0 {
+	conn.sleepAfterConnect = module.Workarounds.SleepAfterConnect
+	if fresh && module.Workarounds.SleepAfterConnect > 0 {
 		time.Sleep(module.Workarounds.SleepAfterConnect)
 	}
 
-	// TODO: Should we reuse this?
-	c := modbus.NewClient(handler)
+	// Transactions are serialized per target across all concurrent scrapes.
+	c := modbus.NewClient2(newPackager(module, subTarget), &scheduledTransporter{
+		Transporter: conn,
+		scheduler:   e.scheduler,
+		target:      targetAddress,
+	})
 
-	// Close tcp connection.
-	defer handler.Close()
-
-	metrics, err := scrapeMetrics(module.Metrics, c, module.Workarounds.ScrapeInterludeWait)
+	metrics, err := scrapeMetrics(module, c, e.suppressed)
 	if err != nil {
+		// The connection might still receive the response to a timed
+		// out request, thus it can't be reused.
+		e.pool.discard(conn)
 		return nil, fmt.Errorf("failed to scrape metrics for module '%v': %v", moduleName, err.Error())
 	}
 
+	idleTimeout := module.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = defaultIdleTimeout
+	}
+	e.pool.put(conn, idleTimeout)
+
 	if err := registerMetrics(reg, moduleName, metrics); err != nil {
 		return nil, fmt.Errorf("failed to register metrics for module %v: %v", moduleName, err.Error())
 	}
@@ -169,102 +224,342 @@ func keys(m map[string]string) []string {
 	return keys
 }
 
-func scrapeMetrics(definitions []config.MetricDef, c modbus.Client, interludewait time.Duration) ([]metric, error) {
-	metrics := []metric{}
-
-	if len(definitions) == 0 {
+func scrapeMetrics(module *config.Module, c modbus.Client, suppressed *prometheus.CounterVec) ([]metric, error) {
+	if len(module.Metrics) == 0 {
 		return []metric{}, nil
 	}
 
-	for _, definition := range definitions {
-		var f modbusFunc
+	requests, err := planReads(module)
+	if err != nil {
+		return []metric{}, err
+	}
 
-		// Here we are parcing Modbus Address from config file
-		// for function code and register address
-		modFunction, err := strconv.ParseUint(fmt.Sprint(definition.Address)[0:1], 10, 64)
+	// Read all requests first, the scale factor of a metric may be returned
+	// by a later request.
+	responses := make([][]byte, len(requests))
+	scaleFactors := map[config.RegisterAddr]int16{}
+	for i, r := range requests {
+		data, err := r.read(c)
 		if err != nil {
-			return []metric{}, fmt.Errorf("modbus function code parcing failed: %v", modFunction)
+			return []metric{}, fmt.Errorf("function code %v, address %v, quantity %v: %v", r.function, r.address, r.quantity, err)
 		}
+		responses[i] = data
 
-		// And here we are parcing Modbus Address from config file
-		// for register address
-		modAddress, err := strconv.ParseUint(fmt.Sprint(definition.Address)[1:], 10, 64)
-		if err != nil {
-			return []metric{}, fmt.Errorf("modbus register address parcing failed  %v", modAddress)
+		for _, m := range r.metrics {
+			if m.scaleFactor {
+				scaleFactors[m.definition.Address] = int16(binary.BigEndian.Uint16(r.slice(data, m)))
+			}
 		}
 
-		if modAddress > 65535 {
-			return []metric{}, fmt.Errorf("modbus register address is out of range: %v", definition.Address)
+		// Some controllers need an interlude timeout between queries
+		time.Sleep(module.Workarounds.ScrapeInterludeWait)
+	}
+
+	// Metrics of each definition, in the order of the definitions.
+	results := make([][]metric, len(module.Metrics))
+	// Decoded values of definitions with an expression, before scaling.
+	raws := make([]float64, len(module.Metrics))
+	for i, r := range requests {
+		for _, m := range r.metrics {
+			if m.scaleFactor {
+				continue
+			}
+			definition := m.definition
+
+			if definition.ScaleFactorAddress != 0 {
+				implemented, err := applyScaleFactor(&definition, scaleFactors[definition.ScaleFactorAddress])
+				if err != nil {
+					return []metric{}, fmt.Errorf("metric '%v', address '%v': %v", definition.Name, definition.Address, err)
+				}
+				if !implemented {
+					continue
+				}
+			}
+
+			var err error
+			results[m.index], err = parseMetrics(definition, r.slice(responses[i], m))
+			var invalid *invalidValueError
+			if errors.As(err, &invalid) {
+				suppressed.WithLabelValues(module.Name, definition.Name).Inc()
+				if module.InvalidValuePolicy == config.InvalidValueNaN {
+					results[m.index] = []metric{{definition.Name, definition.Help, definition.Labels, math.NaN(), definition.MetricType}}
+					raws[m.index] = math.NaN()
+					if len(definition.Enum) > 0 {
+						results[m.index] = enumMetrics(definition, func(string) float64 { return math.NaN() })
+					}
+				}
+				continue
+			}
+			if err != nil {
+				return []metric{}, fmt.Errorf("metric '%v', address '%v': %v", definition.Name, definition.Address, err)
+			}
+
+			// Expressions may refer to the value before any scaling.
+			if definition.Expr != "" && definition.HasSingleValue() {
+				raws[m.index], _ = decodeModbusData(definition, r.slice(responses[i], m))
+			}
 		}
+	}
+
+	if err := applyExpressions(module, results, raws); err != nil {
+		return []metric{}, err
+	}
 
-		switch modFunction {
-		case 1:
-			f = c.ReadCoils
-		case 2:
-			f = c.ReadDiscreteInputs
-		case 3:
-			f = c.ReadHoldingRegisters
-		case 4:
-			f = c.ReadInputRegisters
-		default:
-			return []metric{}, fmt.Errorf(
-				"metric: '%v', address '%v': metric address should be within the range of 10 - 465535."+
-					"'1xxxxx' for read coil / digital output, '2xxxxx' for read discrete inputs / digital input,"+
-					"'3xxxxx' read holding registers / analog output, '4xxxxx' read input registers / analog input",
-				definition.Name, definition.Address,
-			)
+	metrics := []metric{}
+	for _, r := range results {
+		metrics = append(metrics, r...)
+	}
+
+	derived, err := deriveMetrics(module, results)
+	if err != nil {
+		return []metric{}, err
+	}
+
+	return append(metrics, derived...), nil
+}
+
+// deriveMetrics computes the derived metrics of the module from the values of
+// its metrics. Derived metrics referencing a dropped sample are dropped as well.
+func deriveMetrics(module *config.Module, results [][]metric) ([]metric, error) {
+	if len(module.Derived) == 0 {
+		return nil, nil
+	}
+
+	order, err := module.DerivedOrder()
+	if err != nil {
+		return nil, err
+	}
+
+	values := map[string]float64{}
+	for i, definition := range module.Metrics {
+		if len(results[i]) == 1 && definition.HasSingleValue() {
+			values[definition.Name] = results[i][0].Value
 		}
+	}
 
-		m, err := scrapeMetric(definition, f, modAddress)
+	derived := make([]*metric, len(module.Derived))
+	for _, i := range order {
+		definition := module.Derived[i]
+
+		expr, err := config.ParseExpr(definition.Expr)
 		if err != nil {
-			return []metric{}, fmt.Errorf("metric '%v', address '%v': %v", definition.Name, definition.Address, err)
+			return nil, fmt.Errorf("derived metric '%v': expr: %v", definition.Name, err)
 		}
 
-		metrics = append(metrics, m)
-		// Some controllers need an interlude timeout between queries
-		time.Sleep(interludewait)
+		v, err := expr.Eval(values)
+		if err != nil {
+			continue
+		}
+		values[definition.Name] = v
+
+		labels := map[string]string{}
+		for k, v := range definition.Labels {
+			labels[k] = v
+		}
+		derived[i] = &metric{definition.Name, definition.Help, labels, v, definition.MetricType}
+	}
+
+	metrics := []metric{}
+	for _, m := range derived {
+		if m != nil {
+			metrics = append(metrics, *m)
+		}
 	}
 
 	return metrics, nil
 }
 
-// modbus read function type
-type modbusFunc func(address, quantity uint16) ([]byte, error)
-
-// scrapeMetric returns the list of values from a target
-func scrapeMetric(definition config.MetricDef, f modbusFunc, modAddress uint64) (metric, error) {
-	// For now we are not caching any results, thus we can request the
-	// minimum necessary amount of registers per request dependint in the dataType.
-	// For future reference, the maximum for digital in/output is 2000 registers,
-	// the maximum for analog in/output is 125.
-	var div uint16
-	switch definition.DataType {
-	case config.ModbusFloat16,
-		config.ModbusInt16,
-		config.ModbusBool,
-		config.ModbusUInt16:
-		div = uint16(1)
-	case config.ModbusFloat32,
-		config.ModbusInt32,
-		config.ModbusUInt32:
-		div = uint16(2)
-	default:
-		div = uint16(4)
+// applyExpressions replaces the values of metrics with an expression by its
+// result. Expressions see their own value before scaling as raw and the values
+// of all metrics before any expression is applied. Samples whose expression
+// references a dropped sample are dropped as well.
+func applyExpressions(module *config.Module, results [][]metric, raws []float64) error {
+	values := map[string]float64{}
+	for i, definition := range module.Metrics {
+		if len(results[i]) == 1 && definition.HasSingleValue() {
+			values[definition.Name] = results[i][0].Value
+		}
 	}
 
-	// TODO: We could cache the results to not repeat overlapping ones.
+	for i, definition := range module.Metrics {
+		if definition.Expr == "" || len(results[i]) != 1 {
+			continue
+		}
+
+		expr, err := config.ParseExpr(definition.Expr)
+		if err != nil {
+			return fmt.Errorf("metric '%v', address '%v': expr: %v", definition.Name, definition.Address, err)
+		}
 
-	modBytes, err := f(uint16(modAddress), div)
+		variables := map[string]float64{
+			config.ExprValueVariable: results[i][0].Value,
+			config.ExprRawVariable:   raws[i],
+		}
+		for _, v := range expr.Variables() {
+			if value, ok := values[v]; ok && v != config.ExprValueVariable && v != config.ExprRawVariable {
+				variables[v] = value
+			}
+		}
+
+		v, err := expr.Eval(variables)
+		if err != nil {
+			results[i] = nil
+			continue
+		}
+		results[i][0].Value = v
+	}
+
+	return nil
+}
+
+// parseMetrics returns the metrics of a definition based on the given
+// registers or bits.
+func parseMetrics(d config.MetricDef, rawData []byte) ([]metric, error) {
+	switch d.DataType {
+	case config.ModbusBits:
+		return parseBits(d, rawData)
+	case config.ModbusString:
+		return parseString(d, rawData)
+	}
+
+	raw, err := decodeModbusData(d, rawData)
 	if err != nil {
-		return metric{}, err
+		return nil, err
+	}
+	if isInvalid(d, raw) {
+		return nil, &invalidValueError{raw}
+	}
+
+	if len(d.Enum) > 0 {
+		state := d.UnknownState()
+		if s, ok := d.Enum[int64(raw)]; ok && float64(int64(raw)) == raw {
+			state = s
+		}
+		return enumMetrics(d, func(s string) float64 {
+			if s == state {
+				return 1
+			}
+			return 0
+		}), nil
+	}
+
+	v := scaleValue(d, raw)
+	if len(d.Calibration) > 0 {
+		var inRange bool
+		v, inRange = calibrate(d, v)
+		if !inRange && d.CalibrationOutOfRange == config.OutOfRangeDrop {
+			return nil, nil
+		}
+	}
+
+	return []metric{{d.Name, d.Help, d.Labels, v, d.MetricType}}, nil
+}
+
+// enumMetrics returns one metric per state of an enum definition, ordered by
+// raw value and followed by the unknown state, with the value returned by
+// value.
+func enumMetrics(d config.MetricDef, value func(state string) float64) []metric {
+	raws := make([]int64, 0, len(d.Enum))
+	for raw := range d.Enum {
+		raws = append(raws, raw)
+	}
+	sort.Slice(raws, func(i, j int) bool { return raws[i] < raws[j] })
+
+	states := make([]string, 0, len(d.Enum)+1)
+	for _, raw := range raws {
+		states = append(states, d.Enum[raw])
+	}
+	states = append(states, d.UnknownState())
+
+	metrics := make([]metric, 0, len(states))
+	for _, state := range states {
+		labels := map[string]string{config.EnumStateLabel: state}
+		for k, v := range d.Labels {
+			labels[k] = v
+		}
+		metrics = append(metrics, metric{d.Name, d.Help, labels, value(state), d.MetricType})
+	}
+
+	return metrics
+}
+
+// invalidValueError is returned by parseMetrics for readings matching the
+// invalid values or outside of the valid range of the definition.
+type invalidValueError struct {
+	value float64
+}
+
+func (e *invalidValueError) Error() string {
+	return fmt.Sprintf("invalid value %v", e.value)
+}
+
+// isInvalid returns whether the raw value matches one of the invalid values or
+// is outside of the valid range of the definition.
+func isInvalid(d config.MetricDef, raw float64) bool {
+	for _, v := range d.InvalidValues {
+		if raw == v || math.IsNaN(raw) && math.IsNaN(v) {
+			return true
+		}
+	}
+
+	if r := d.ValidRange; r != nil {
+		// NaN is outside of any range.
+		if math.IsNaN(raw) || r.Min != nil && raw < *r.Min || r.Max != nil && raw > *r.Max {
+			return true
+		}
+	}
+
+	return false
+}
+
+// parseString returns an info metric with the text of the registers in a
+// label. The text ends at the first NUL byte and padding spaces are trimmed.
+func parseString(d config.MetricDef, rawData []byte) ([]metric, error) {
+	if len(rawData) != d.Length*2 {
+		return nil, &InsufficientRegistersError{fmt.Sprintf("expected %v bytes, got %v", d.Length*2, len(rawData))}
 	}
 
-	v, err := parseModbusData(definition, modBytes)
+	data, err := convertByteOrder(d, rawData)
 	if err != nil {
-		return metric{}, err
+		return nil, err
+	}
+
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		data = data[:i]
+	}
+	text := strings.ToValidUTF8(strings.Trim(string(data), " "), "\uFFFD")
+
+	label := d.StringLabel
+	if label == "" {
+		label = "value"
+	}
+	labels := map[string]string{label: text}
+	for k, v := range d.Labels {
+		labels[k] = v
+	}
+
+	return []metric{{d.Name, d.Help, labels, 1, d.MetricType}}, nil
+}
+
+// parseBits returns one metric per bit of a bits definition, labelled with the
+// position of the bit relative to the address of the definition.
+func parseBits(d config.MetricDef, rawData []byte) ([]metric, error) {
+	if len(rawData) < (d.BitCount+7)/8 {
+		return nil, &InsufficientRegistersError{fmt.Sprintf("expected %v bytes, got %v", (d.BitCount+7)/8, len(rawData))}
+	}
+
+	metrics := make([]metric, 0, d.BitCount)
+	for i := 0; i < d.BitCount; i++ {
+		labels := map[string]string{"bit": strconv.Itoa(i)}
+		for k, v := range d.Labels {
+			labels[k] = v
+		}
+
+		v := float64((rawData[i/8] >> (i % 8)) & 1)
+		metrics = append(metrics, metric{d.Name, d.Help, labels, v, d.MetricType})
 	}
 
-	return metric{definition.Name, definition.Help, definition.Labels, v, definition.MetricType}, nil
+	return metrics, nil
 }
 
 // InsufficientRegistersError is returned in Parse() whenever not enough
@@ -280,12 +575,38 @@ func (e *InsufficientRegistersError) Error() string {
 
 // Parse parses the given byte slice based on the specified Modbus data type and
 // returns the parsed value as a float64 (Prometheus exposition format).
-//
-// TODO: Handle Endianness.
 func parseModbusData(d config.MetricDef, rawData []byte) (float64, error) {
+	v, err := decodeModbusData(d, rawData)
+	if err != nil {
+		return float64(0), err
+	}
+
+	return scaleValue(d, v), nil
+}
+
+// decodeModbusData decodes the given byte slice based on the specified Modbus
+// data type, before applying any scaling.
+func decodeModbusData(d config.MetricDef, rawData []byte) (float64, error) {
 	switch d.DataType {
 	case config.ModbusBool:
 		{
+			// Coils and discrete inputs are packed into bytes starting
+			// with the least significant bit.
+			if len(rawData) == 1 {
+				offset := 0
+				if d.BitOffset != nil {
+					offset = *d.BitOffset
+				}
+				if offset < 0 || offset > 7 {
+					return float64(0), fmt.Errorf("bit position %v out of range for a single byte", offset)
+				}
+
+				return float64((rawData[0] >> offset) & 1), nil
+			}
+
+			if len(rawData) != 2 {
+				return float64(0), &InsufficientRegistersError{fmt.Sprintf("expected 1 or 2 bytes, got %v", len(rawData))}
+			}
 			if d.BitOffset == nil {
 				return float64(0), fmt.Errorf("expected bit position on boolean data type")
 			}
@@ -303,103 +624,219 @@ func parseModbusData(d config.MetricDef, rawData []byte) (float64, error) {
 			if len(rawData) != 2 {
 				return float64(0), &InsufficientRegistersError{fmt.Sprintf("expected 2 bytes, got %v", len(rawData))}
 			}
-			panic("implement")
+			rawDataWithEndianness, err := convertByteOrder(d, rawData)
+			if err != nil {
+				return float64(0), err
+			}
+			data := binary.BigEndian.Uint16(rawDataWithEndianness)
+			return float16frombits(data), nil
+		}
+	case config.ModbusBFloat16:
+		{
+			if len(rawData) != 2 {
+				return float64(0), &InsufficientRegistersError{fmt.Sprintf("expected 2 bytes, got %v", len(rawData))}
+			}
+			rawDataWithEndianness, err := convertByteOrder(d, rawData)
+			if err != nil {
+				return float64(0), err
+			}
+			data := binary.BigEndian.Uint16(rawDataWithEndianness)
+			return float64(math.Float32frombits(uint32(data) << 16)), nil
 		}
 	case config.ModbusInt16:
 		{
 			if len(rawData) != 2 {
 				return float64(0), &InsufficientRegistersError{fmt.Sprintf("expected 2 bytes, got %v", len(rawData))}
 			}
-			rawDataWithEndianness, err := convertEndianness16b(d.Endianness, rawData)
+			rawDataWithEndianness, err := convertByteOrder(d, rawData)
 			if err != nil {
 				return float64(0), err
 			}
 			data := binary.BigEndian.Uint16(rawDataWithEndianness)
-			return scaleValue(d.Factor, float64(int16(data))), nil
+			if d.BitLength != 0 {
+				return bitField(d, uint64(data), true), nil
+			}
+			return decodeSigned(d, uint64(data), 16), nil
 		}
 	case config.ModbusUInt16:
 		{
 			if len(rawData) != 2 {
 				return float64(0), &InsufficientRegistersError{fmt.Sprintf("expected 2 bytes, got %v", len(rawData))}
 			}
-			rawDataWithEndianness, err := convertEndianness16b(d.Endianness, rawData)
+			rawDataWithEndianness, err := convertByteOrder(d, rawData)
 			if err != nil {
 				return float64(0), err
 			}
 			data := binary.BigEndian.Uint16(rawDataWithEndianness)
-			return scaleValue(d.Factor, float64(data)), nil
+			if d.BitLength != 0 {
+				return bitField(d, uint64(data), false), nil
+			}
+			return float64(data), nil
 		}
 	case config.ModbusInt32:
 		{
 			if len(rawData) != 4 {
 				return float64(0), &InsufficientRegistersError{fmt.Sprintf("expected 4 bytes, got %v", len(rawData))}
 			}
-			rawDataWithEndianness, err := convertEndianness32b(d.Endianness, rawData)
+			rawDataWithEndianness, err := convertByteOrder(d, rawData)
 			if err != nil {
 				return float64(0), err
 			}
 			data := binary.BigEndian.Uint32(rawDataWithEndianness)
-			return scaleValue(d.Factor, float64(int32(data))), nil
+			if d.BitLength != 0 {
+				return bitField(d, uint64(data), true), nil
+			}
+			return decodeSigned(d, uint64(data), 32), nil
 		}
 	case config.ModbusUInt32:
 		{
 			if len(rawData) != 4 {
 				return float64(0), &InsufficientRegistersError{fmt.Sprintf("expected 4 bytes, got %v", len(rawData))}
 			}
-			rawDataWithEndianness, err := convertEndianness32b(d.Endianness, rawData)
+			rawDataWithEndianness, err := convertByteOrder(d, rawData)
 			if err != nil {
 				return float64(0), err
 			}
 			data := binary.BigEndian.Uint32(rawDataWithEndianness)
-			return scaleValue(d.Factor, float64(data)), nil
+			if d.BitLength != 0 {
+				return bitField(d, uint64(data), false), nil
+			}
+			return float64(data), nil
 		}
 	case config.ModbusFloat32:
 		{
 			if len(rawData) != 4 {
 				return float64(0), &InsufficientRegistersError{fmt.Sprintf("expected 4 bytes, got %v", len(rawData))}
 			}
-			rawDataWithEndianness, err := convertEndianness32b(d.Endianness, rawData)
+			rawDataWithEndianness, err := convertByteOrder(d, rawData)
 			if err != nil {
 				return float64(0), err
 			}
 			data := binary.BigEndian.Uint32(rawDataWithEndianness)
-			return scaleValue(d.Factor, float64(math.Float32frombits(data))), nil
+			return float64(math.Float32frombits(data)), nil
 		}
 	case config.ModbusInt64:
 		{
 			if len(rawData) != 8 {
 				return float64(0), &InsufficientRegistersError{fmt.Sprintf("expected 8 bytes, got %v", len(rawData))}
 			}
-			rawDataWithEndianness, err := convertEndianness64b(d.Endianness, rawData)
+			rawDataWithEndianness, err := convertByteOrder(d, rawData)
 			if err != nil {
 				return float64(0), err
 			}
 			data := binary.BigEndian.Uint64(rawDataWithEndianness)
-			return scaleValue(d.Factor, float64(int64(data))), nil
+			if d.BitLength != 0 {
+				return bitField(d, uint64(data), true), nil
+			}
+			return decodeSigned(d, data, 64), nil
 		}
 	case config.ModbusUInt64:
 		{
 			if len(rawData) != 8 {
 				return float64(0), &InsufficientRegistersError{fmt.Sprintf("expected 8 bytes, got %v", len(rawData))}
 			}
-			rawDataWithEndianness, err := convertEndianness64b(d.Endianness, rawData)
+			rawDataWithEndianness, err := convertByteOrder(d, rawData)
 			if err != nil {
 				return float64(0), err
 			}
 			data := binary.BigEndian.Uint64(rawDataWithEndianness)
-			return scaleValue(d.Factor, float64(data)), nil
+			if d.BitLength != 0 {
+				return bitField(d, uint64(data), false), nil
+			}
+			return float64(data), nil
 		}
 	case config.ModbusFloat64:
 		{
 			if len(rawData) != 8 {
 				return float64(0), &InsufficientRegistersError{fmt.Sprintf("expected 8 bytes, got %v", len(rawData))}
 			}
-			rawDataWithEndianness, err := convertEndianness64b(d.Endianness, rawData)
+			rawDataWithEndianness, err := convertByteOrder(d, rawData)
 			if err != nil {
 				return float64(0), err
 			}
 			data := binary.BigEndian.Uint64(rawDataWithEndianness)
-			return scaleValue(d.Factor, math.Float64frombits(data)), nil
+			return math.Float64frombits(data), nil
+		}
+	case config.ModbusInt48, config.ModbusUInt48:
+		{
+			if len(rawData) != 6 {
+				return float64(0), &InsufficientRegistersError{fmt.Sprintf("expected 6 bytes, got %v", len(rawData))}
+			}
+			return parseInteger(d, rawData, d.DataType == config.ModbusInt48)
+		}
+	case config.ModbusInt, config.ModbusUInt:
+		{
+			if len(rawData) != d.Length*2 || len(rawData) > 8 {
+				return float64(0), &InsufficientRegistersError{fmt.Sprintf("expected %v bytes, got %v", d.Length*2, len(rawData))}
+			}
+			return parseInteger(d, rawData, d.DataType == config.ModbusInt)
+		}
+	case config.ModbusInt8:
+		{
+			data, err := selectByte(d, rawData)
+			if err != nil {
+				return float64(0), err
+			}
+			if d.BitLength != 0 {
+				return bitField(d, uint64(data), true), nil
+			}
+			return decodeSigned(d, uint64(data), 8), nil
+		}
+	case config.ModbusUInt8:
+		{
+			data, err := selectByte(d, rawData)
+			if err != nil {
+				return float64(0), err
+			}
+			if d.BitLength != 0 {
+				return bitField(d, uint64(data), false), nil
+			}
+			return float64(data), nil
+		}
+	case config.ModbusBCD16:
+		{
+			if len(rawData) != 2 {
+				return float64(0), &InsufficientRegistersError{fmt.Sprintf("expected 2 bytes, got %v", len(rawData))}
+			}
+			rawDataWithEndianness, err := convertByteOrder(d, rawData)
+			if err != nil {
+				return float64(0), err
+			}
+			data, err := decodeBCD(rawDataWithEndianness)
+			if err != nil {
+				return float64(0), err
+			}
+			return float64(data), nil
+		}
+	case config.ModbusBCD32:
+		{
+			if len(rawData) != 4 {
+				return float64(0), &InsufficientRegistersError{fmt.Sprintf("expected 4 bytes, got %v", len(rawData))}
+			}
+			rawDataWithEndianness, err := convertByteOrder(d, rawData)
+			if err != nil {
+				return float64(0), err
+			}
+			data, err := decodeBCD(rawDataWithEndianness)
+			if err != nil {
+				return float64(0), err
+			}
+			return float64(data), nil
+		}
+	case config.ModbusBCD64:
+		{
+			if len(rawData) != 8 {
+				return float64(0), &InsufficientRegistersError{fmt.Sprintf("expected 8 bytes, got %v", len(rawData))}
+			}
+			rawDataWithEndianness, err := convertByteOrder(d, rawData)
+			if err != nil {
+				return float64(0), err
+			}
+			data, err := decodeBCD(rawDataWithEndianness)
+			if err != nil {
+				return float64(0), err
+			}
+			return float64(data), nil
 		}
 	default:
 		{
@@ -408,120 +845,271 @@ func parseModbusData(d config.MetricDef, rawData []byte) (float64, error) {
 	}
 }
 
-// Scales value by factor
-func scaleValue(f *float64, d float64) float64 {
-	if f == nil {
-		return d
+// parseInteger decodes an integer of up to four registers, applying the
+// endianness, bit field and encoding of the definition.
+func parseInteger(d config.MetricDef, rawData []byte, signed bool) (float64, error) {
+	rawDataWithEndianness, err := convertByteOrder(d, rawData)
+	if err != nil {
+		return float64(0), err
+	}
+
+	var data uint64
+	for _, b := range rawDataWithEndianness {
+		data = data<<8 | uint64(b)
+	}
+
+	if d.BitLength != 0 {
+		return bitField(d, data, signed), nil
+	}
+
+	if signed {
+		return decodeSigned(d, data, 8*len(rawData)), nil
 	}
-	return (d * float64(*f))
+	return float64(data), nil
 }
 
-// Converts an array of 16 bits from an endianness to the default big Endian
-func convertEndianness16b(rawEndianness config.EndiannessType, rawData []byte) ([]byte, error) {
+// selectByte returns the high or low byte of the register, as selected by the
+// definition.
+func selectByte(d config.MetricDef, rawData []byte) (uint8, error) {
 	if len(rawData) != 2 {
-		return []byte{uint8(0), uint8(0)}, fmt.Errorf("expected 2 bytes, got %v", len(rawData))
-	}
-	var data []byte
-	switch rawEndianness {
-	case config.EndiannessLittleEndian:
-		data = []byte{
-			rawData[1],
-			rawData[0]}
-	// default: BigEndian
+		return 0, &InsufficientRegistersError{fmt.Sprintf("expected 2 bytes, got %v", len(rawData))}
+	}
+	rawDataWithEndianness, err := convertByteOrder(d, rawData)
+	if err != nil {
+		return 0, err
+	}
+
+	switch d.Byte {
+	case config.ByteHigh:
+		return rawDataWithEndianness[0], nil
+	case config.ByteLow:
+		return rawDataWithEndianness[1], nil
 	default:
-		data = []byte{
-			rawData[0],
-			rawData[1]}
+		return 0, fmt.Errorf("expected byte to be one of %v, %v but got '%v'", config.ByteHigh, config.ByteLow, d.Byte)
 	}
-	return data, nil
 }
 
-// Converts an array of 32 bits from an endianness to the default big Endian
-func convertEndianness32b(rawEndianness config.EndiannessType, rawData []byte) ([]byte, error) {
-	if len(rawData) != 4 {
-		return []byte{uint8(0), uint8(0), uint8(0), uint8(0)},
-			fmt.Errorf("expected 4 bytes, got %v", len(rawData))
-	}
-	var data []byte
-	switch rawEndianness {
-	case config.EndiannessLittleEndian:
-		data = []byte{
-			rawData[3],
-			rawData[2],
-			rawData[1],
-			rawData[0]}
-	case config.EndiannessMixedEndian:
-		data = []byte{
-			rawData[1],
-			rawData[0],
-			rawData[3],
-			rawData[2]}
-	case config.EndiannessYolo:
-		data = []byte{
-			rawData[2],
-			rawData[3],
-			rawData[0],
-			rawData[1]}
-	// default: BigEndian
+// bitField returns the BitLength bits at BitOffset of the given integer,
+// decoded as signed integer if signed.
+func bitField(d config.MetricDef, data uint64, signed bool) float64 {
+	offset := 0
+	if d.BitOffset != nil {
+		offset = *d.BitOffset
+	}
+
+	field := (data >> offset) & mask(d.BitLength)
+	if signed {
+		return decodeSigned(d, field, d.BitLength)
+	}
+	return float64(field)
+}
+
+// decodeSigned returns the signed integer in the width least significant bits
+// of data, in the encoding of the definition.
+func decodeSigned(d config.MetricDef, data uint64, width int) float64 {
+	negative := (data>>(width-1))&1 == 1
+
+	switch d.Encoding {
+	case config.EncodingSignMagnitude:
+		magnitude := float64(data & mask(width-1))
+		if negative {
+			return -magnitude
+		}
+		return magnitude
+	case config.EncodingOnesComplement:
+		if negative {
+			return -float64(^data & mask(width))
+		}
+		return float64(data & mask(width))
+	// default: two's complement
 	default:
-		data = []byte{
-			rawData[0],
-			rawData[1],
-			rawData[2],
-			rawData[3]}
+		// Shift the sign bit to the top and back down to extend it.
+		return float64(int64(data<<(64-width)) >> (64 - width))
 	}
-	return data, nil
 }
 
-// Converts an array of 64 bits from an endianness to the default big Endian
-func convertEndianness64b(rawEndianness config.EndiannessType, rawData []byte) ([]byte, error) {
-	if len(rawData) != 8 {
-		return []byte{uint8(0), uint8(0), uint8(0), uint8(0), uint8(0), uint8(0), uint8(0), uint8(0)},
-			fmt.Errorf("expected 8 bytes, got %v", len(rawData))
-	}
-	var data []byte
-	switch rawEndianness {
-	case config.EndiannessLittleEndian:
-		data = []byte{
-			rawData[7],
-			rawData[6],
-			rawData[5],
-			rawData[4],
-			rawData[3],
-			rawData[2],
-			rawData[1],
-			rawData[0]}
-	case config.EndiannessMixedEndian:
-		data = []byte{
-			rawData[1],
-			rawData[0],
-			rawData[3],
-			rawData[2],
-			rawData[5],
-			rawData[4],
-			rawData[7],
-			rawData[6]}
-	case config.EndiannessYolo:
-		data = []byte{
-			rawData[6],
-			rawData[7],
-			rawData[4],
-			rawData[5],
-			rawData[2],
-			rawData[3],
-			rawData[0],
-			rawData[1]}
-	// default: BigEndian
+// mask returns a mask of the width least significant bits.
+func mask(width int) uint64 {
+	if width >= 64 {
+		return ^uint64(0)
+	}
+	return 1<<width - 1
+}
+
+// decodeBCD returns the value of the given binary coded decimal in big
+// endianness, with the most significant digit in the upper nibble of the first
+// byte.
+func decodeBCD(data []byte) (uint64, error) {
+	var v uint64
+	for _, b := range data {
+		for _, digit := range []byte{b >> 4, b & 0x0f} {
+			if digit > 9 {
+				return 0, fmt.Errorf("invalid BCD digit %X in %X", digit, data)
+			}
+			v = v*10 + uint64(digit)
+		}
+	}
+	return v, nil
+}
+
+// float16frombits returns the value of the IEEE 754 binary16 floating point
+// number with the given bits: 1 sign, 5 exponent and 10 mantissa bits.
+func float16frombits(b uint16) float64 {
+	sign := 1.0
+	if b&0x8000 != 0 {
+		sign = -1.0
+	}
+	exponent := int(b>>10) & 0x1f
+	mantissa := float64(b & 0x3ff)
+
+	switch exponent {
+	// Zero and subnormal numbers
+	case 0:
+		return sign * math.Ldexp(mantissa, -24)
+	case 0x1f:
+		if mantissa != 0 {
+			return math.NaN()
+		}
+		return math.Inf(int(sign))
 	default:
-		data = []byte{
-			rawData[0],
-			rawData[1],
-			rawData[2],
-			rawData[3],
-			rawData[4],
-			rawData[5],
-			rawData[6],
-			rawData[7]}
+		return sign * math.Ldexp(1024+mantissa, exponent-25)
+	}
+}
+
+// calibrate maps the value through the calibration table of the definition,
+// interpolating linearly between its points. Values outside of the table are
+// clamped to its ends, unless they are extrapolated from its first or last
+// segment. It returns false if the value is outside of the table.
+func calibrate(d config.MetricDef, v float64) (float64, bool) {
+	if math.IsNaN(v) {
+		return v, false
+	}
+
+	points := d.Calibration
+	first, last := points[0], points[len(points)-1]
+
+	inRange := v >= first.Raw && v <= last.Raw
+	if !inRange && d.CalibrationOutOfRange != config.OutOfRangeExtrapolate {
+		if v < first.Raw {
+			return first.Value, false
+		}
+		return last.Value, false
+	}
+
+	// Index of the segment from points[i-1] to points[i] containing v.
+	i := sort.Search(len(points), func(i int) bool { return points[i].Raw >= v })
+	if i == 0 {
+		i = 1
+	}
+	if i == len(points) {
+		i = len(points) - 1
+	}
+
+	from, to := points[i-1], points[i]
+	return from.Value + (v-from.Raw)*(to.Value-from.Value)/(to.Raw-from.Raw), inRange
+}
+
+// Range of valid scale factors and the value of unimplemented ones as defined
+// by SunSpec.
+const (
+	minScaleFactor           = -10
+	maxScaleFactor           = 10
+	unimplementedScaleFactor = math.MinInt16
+)
+
+// applyScaleFactor multiplies the factor of the definition with the power of
+// ten given by the scale factor. It returns false if the scale factor is not
+// implemented by the device, in which case the sample is dropped.
+func applyScaleFactor(d *config.MetricDef, sf int16) (bool, error) {
+	if sf == unimplementedScaleFactor {
+		return false, nil
+	}
+	if sf < minScaleFactor || sf > maxScaleFactor {
+		return false, fmt.Errorf("scale factor %v out of range %v to %v", sf, minScaleFactor, maxScaleFactor)
+	}
+
+	factor := 1.0
+	if d.Factor != nil {
+		factor = *d.Factor
+	}
+	factor *= math.Pow10(int(sf))
+	d.Factor = &factor
+
+	return true, nil
+}
+
+// scaleValue applies the factor and offset of the definition, followed by its
+// transform:
+//
+//	v = raw * factor + offset
+//	v = (v + preOffset) * transform.factor / divisor + postOffset
+func scaleValue(d config.MetricDef, v float64) float64 {
+	if d.Factor != nil {
+		v *= *d.Factor
+	}
+	if d.Offset != nil {
+		v += *d.Offset
+	}
+
+	if t := d.Transform; t != nil {
+		v += t.PreOffset
+		if t.Factor != nil {
+			v *= *t.Factor
+		}
+		if t.Divisor != nil {
+			v /= *t.Divisor
+		}
+		v += t.PostOffset
+	}
+
+	return v
+}
+
+// convertByteOrder converts the registers of a value from the byte, word and
+// register order of the definition to big endian:
+//
+//	byteOrder little swaps the two bytes of each register: 2 1 4 3
+//	wordOrder little reverses the order of the registers: 3 4 1 2
+//
+// For 64 bit values wordOrder orders the two 32 bit words and registerOrder
+// the two registers within each word:
+//
+//	wordOrder little, registerOrder big: 5 6 7 8 1 2 3 4
+//	wordOrder big, registerOrder little: 3 4 1 2 7 8 5 6
+func convertByteOrder(d config.MetricDef, rawData []byte) ([]byte, error) {
+	if len(rawData)%2 != 0 {
+		return nil, fmt.Errorf("expected an even number of bytes, got %v", len(rawData))
+	}
+	byteOrder, wordOrder, registerOrder := d.Orders()
+
+	// Position of each register in rawData, most significant first.
+	n := len(rawData) / 2
+	registers := make([]int, n)
+	for i := range registers {
+		registers[i] = i
+	}
+
+	if n == 4 {
+		if wordOrder == config.OrderLittle {
+			registers = []int{2, 3, 0, 1}
+		}
+		if registerOrder == config.OrderLittle {
+			registers[0], registers[1] = registers[1], registers[0]
+			registers[2], registers[3] = registers[3], registers[2]
+		}
+	} else if wordOrder == config.OrderLittle {
+		for i := range registers {
+			registers[i] = n - 1 - i
+		}
+	}
+
+	data := make([]byte, len(rawData))
+	for i, r := range registers {
+		high, low := rawData[2*r], rawData[2*r+1]
+		if byteOrder == config.OrderLittle {
+			high, low = low, high
+		}
+		data[2*i], data[2*i+1] = high, low
 	}
 	return data, nil
 }
@@ -14,12 +14,19 @@
 package modbus
 
 import (
+	"bytes"
 	"encoding/binary"
+	"fmt"
 	"math"
+	"net"
+	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/RichiH/modbus_exporter/config"
+	"github.com/go-kit/log"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tbrandon/mbserver"
 )
 
 func TestRegisterMetrics(t *testing.T) {
@@ -517,6 +524,931 @@ func TestParseModbusDataFloat32(t *testing.T) {
 	}
 }
 
+func TestParseModbusDataFloat16(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		dataType   config.ModbusDataType
+		endianness config.EndiannessType
+		input      []byte
+		expected   float64
+	}{
+		{"float16 one", config.ModbusFloat16, config.EndiannessBigEndian, []byte{0x3c, 0x00}, 1},
+		{"float16 negative", config.ModbusFloat16, config.EndiannessBigEndian, []byte{0xc0, 0x00}, -2},
+		{"float16 fraction", config.ModbusFloat16, config.EndiannessBigEndian, []byte{0x35, 0x55}, 0.333251953125},
+		{"float16 max", config.ModbusFloat16, config.EndiannessBigEndian, []byte{0x7b, 0xff}, 65504},
+		{"float16 smallest subnormal", config.ModbusFloat16, config.EndiannessBigEndian, []byte{0x00, 0x01}, math.Ldexp(1, -24)},
+		{"float16 largest subnormal", config.ModbusFloat16, config.EndiannessBigEndian, []byte{0x03, 0xff}, 1023 * math.Ldexp(1, -24)},
+		{"float16 infinity", config.ModbusFloat16, config.EndiannessBigEndian, []byte{0x7c, 0x00}, math.Inf(1)},
+		{"float16 negative infinity", config.ModbusFloat16, config.EndiannessBigEndian, []byte{0xfc, 0x00}, math.Inf(-1)},
+		{"float16 NaN", config.ModbusFloat16, config.EndiannessBigEndian, []byte{0x7e, 0x00}, math.NaN()},
+		{"float16 little endian", config.ModbusFloat16, config.EndiannessLittleEndian, []byte{0x00, 0x3c}, 1},
+		{"bfloat16 one", config.ModbusBFloat16, config.EndiannessBigEndian, []byte{0x3f, 0x80}, 1},
+		{"bfloat16 negative", config.ModbusBFloat16, config.EndiannessBigEndian, []byte{0xc2, 0xf7}, -123.5},
+		{"bfloat16 infinity", config.ModbusBFloat16, config.EndiannessBigEndian, []byte{0x7f, 0x80}, math.Inf(1)},
+		{"bfloat16 NaN", config.ModbusBFloat16, config.EndiannessBigEndian, []byte{0x7f, 0xc0}, math.NaN()},
+		{"bfloat16 little endian", config.ModbusBFloat16, config.EndiannessLittleEndian, []byte{0x80, 0x3f}, 1},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			def := config.MetricDef{
+				DataType:   test.dataType,
+				Endianness: test.endianness,
+			}
+
+			v, err := parseModbusData(def, test.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if math.IsNaN(test.expected) {
+				if !math.IsNaN(v) {
+					t.Fatalf("expected NaN but got %v", v)
+				}
+				return
+			}
+			if v != test.expected {
+				t.Fatalf("expected %v but got %v", test.expected, v)
+			}
+		})
+	}
+}
+
+func TestParseBits(t *testing.T) {
+	d := config.MetricDef{
+		Name:     "alarm",
+		Labels:   map[string]string{"phase": "1"},
+		DataType: config.ModbusBits,
+		BitCount: 10,
+	}
+
+	metrics, err := parseBits(d, []byte{0b00000101, 0b10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(metrics) != 10 {
+		t.Fatalf("expected 10 metrics but got %v", len(metrics))
+	}
+	for i, expected := range []float64{1, 0, 1, 0, 0, 0, 0, 0, 0, 1} {
+		m := metrics[i]
+		if m.Value != expected {
+			t.Errorf("expected bit %v to be %v but got %v", i, expected, m.Value)
+		}
+		if m.Labels["bit"] != strconv.Itoa(i) || m.Labels["phase"] != "1" {
+			t.Errorf("unexpected labels %v for bit %v", m.Labels, i)
+		}
+	}
+
+	if _, err := parseBits(d, []byte{0}); err == nil {
+		t.Fatal("expected error with insufficient data")
+	}
+}
+
+func TestParseMetricsEnum(t *testing.T) {
+	d := config.MetricDef{
+		Name:       "mode",
+		Labels:     map[string]string{"unit": "1"},
+		DataType:   config.ModbusUInt16,
+		Enum:       map[int64]string{2: "running", 0: "off", 1: "standby", 3: "fault"},
+		MetricType: config.MetricTypeGauge,
+	}
+
+	tests := []struct {
+		name        string
+		enumUnknown string
+		input       []byte
+		expected    string
+	}{
+		{"known state", "", []byte{0x00, 0x02}, "off=0 standby=0 running=1 fault=0 unknown=0"},
+		{"unknown state", "", []byte{0x00, 0x07}, "off=0 standby=0 running=0 fault=0 unknown=1"},
+		{"custom unknown state", "other", []byte{0x00, 0x07}, "off=0 standby=0 running=0 fault=0 other=1"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := d
+			d.EnumUnknown = test.enumUnknown
+
+			metrics, err := parseMetrics(d, test.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			states := []string{}
+			for _, m := range metrics {
+				if m.Labels["unit"] != "1" {
+					t.Errorf("expected label unit on state %v but got %v", m.Labels["state"], m.Labels)
+				}
+				states = append(states, fmt.Sprintf("%v=%v", m.Labels["state"], m.Value))
+			}
+			if got := strings.Join(states, " "); got != test.expected {
+				t.Fatalf("expected states %v but got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestScrapeCoils(t *testing.T) {
+	s := mbserver.NewServer()
+	s.Coils[10] = 1
+	s.Coils[12] = 1
+	s.DiscreteInputs[20] = 1
+	s.HoldingRegisters[30] = 0x0008
+
+	address := listenTCP(t, func(conn net.Conn) {
+		serveMBAP(s, conn)
+	})
+
+	three := 3
+	exporter := NewExporter(config.Config{
+		Modules: []config.Module{
+			{
+				Name:     "coils",
+				Protocol: config.ModbusProtocolTCPIP,
+				Timeout:  1000,
+				Metrics: []config.MetricDef{
+					{Name: "coil_off", Address: 100011, DataType: config.ModbusBool, MetricType: config.MetricTypeGauge},
+					{Name: "coil_on", Address: 100012, DataType: config.ModbusBool, MetricType: config.MetricTypeGauge},
+					{Name: "input", Address: 200020, DataType: config.ModbusBool, MetricType: config.MetricTypeGauge},
+					{Name: "flag", Address: 300030, DataType: config.ModbusBool, BitOffset: &three, MetricType: config.MetricTypeGauge},
+					{Name: "coils", Address: 100010, DataType: config.ModbusBits, BitCount: 4, MetricType: config.MetricTypeGauge},
+				},
+			},
+		},
+	}, log.NewNopLogger())
+
+	g, err := exporter.Scrape(address, 1, "coils")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]float64{"coil_off": 0, "coil_on": 1, "input": 1, "flag": 1} {
+		if v := gatheredValue(t, g, name); v != expected {
+			t.Errorf("expected %v to be %v but got %v", name, expected, v)
+		}
+	}
+
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != "coils" {
+			continue
+		}
+
+		bits := map[string]float64{}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "bit" {
+					bits[l.GetValue()] = m.GetGauge().GetValue()
+				}
+			}
+		}
+		expected := map[string]float64{"0": 1, "1": 0, "2": 1, "3": 0}
+		if fmt.Sprint(bits) != fmt.Sprint(expected) {
+			t.Fatalf("expected bits %v but got %v", expected, bits)
+		}
+		return
+	}
+	t.Fatal("expected coils metric")
+}
+
+func TestScrapeScaleFactor(t *testing.T) {
+	s := mbserver.NewServer()
+	s.HoldingRegisters[10] = 1234
+	s.HoldingRegisters[11] = 0xfffe // -2
+	s.HoldingRegisters[12] = 7
+	s.HoldingRegisters[13] = 0x8000 // not implemented
+	s.HoldingRegisters[14] = 5
+	s.HoldingRegisters[15] = 11
+	s.HoldingRegisters[20] = 3
+
+	address := listenTCP(t, func(conn net.Conn) {
+		serveMBAP(s, conn)
+	})
+
+	two := 2.0
+	exporter := NewExporter(config.Config{
+		Modules: []config.Module{
+			{
+				Name:     "sunspec",
+				Protocol: config.ModbusProtocolTCPIP,
+				Timeout:  1000,
+				Metrics: []config.MetricDef{
+					{Name: "current", Address: 300010, DataType: config.ModbusUInt16, ScaleFactorAddress: 300011, MetricType: config.MetricTypeGauge},
+					{Name: "power", Address: 300012, DataType: config.ModbusUInt16, ScaleFactorAddress: 300020, Factor: &two, MetricType: config.MetricTypeGauge},
+					{Name: "energy", Address: 300012, DataType: config.ModbusUInt16, ScaleFactorAddress: 300013, MetricType: config.MetricTypeGauge},
+				},
+			},
+			{
+				Name:     "invalid",
+				Protocol: config.ModbusProtocolTCPIP,
+				Timeout:  1000,
+				Metrics: []config.MetricDef{
+					{Name: "voltage", Address: 300014, DataType: config.ModbusUInt16, ScaleFactorAddress: 300015, MetricType: config.MetricTypeGauge},
+				},
+			},
+		},
+	}, log.NewNopLogger())
+
+	g, err := exporter.Scrape(address, 1, "sunspec")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]float64{"current": 12.34, "power": 14000} {
+		if v := gatheredValue(t, g, name); v != expected {
+			t.Errorf("expected %v to be %v but got %v", name, expected, v)
+		}
+	}
+
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() == "energy" {
+			t.Errorf("expected sample with unimplemented scale factor to be dropped")
+		}
+	}
+
+	if _, err := exporter.Scrape(address, 1, "invalid"); err == nil {
+		t.Fatal("expected scale factor out of range to fail the scrape")
+	}
+}
+
+func TestParseString(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		endianness config.EndiannessType
+		label      string
+		input      []byte
+		expected   string
+	}{
+		{"padded with spaces", config.EndiannessBigEndian, "", []byte("  SN1234  "), "SN1234"},
+		{"padded with NUL", config.EndiannessBigEndian, "", []byte("v1.2\x00\x00"), "v1.2"},
+		{"text after NUL", config.EndiannessBigEndian, "", []byte("AB\x00\x00CD"), "AB"},
+		{"bytes swapped per register", config.EndiannessMixedEndian, "", []byte("OMED"), "MODE"},
+		{"reversed", config.EndiannessLittleEndian, "", []byte("\x00LEDOM"), "MODEL"},
+		{"invalid UTF-8", config.EndiannessBigEndian, "", []byte("A\xffB "), "A\uFFFDB"},
+		{"custom label", config.EndiannessBigEndian, "serial", []byte("SN"), "SN"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			d := config.MetricDef{
+				Name:        "device_info",
+				Labels:      map[string]string{"vendor": "acme"},
+				DataType:    config.ModbusString,
+				Endianness:  test.endianness,
+				Length:      len(test.input) / 2,
+				StringLabel: test.label,
+				MetricType:  config.MetricTypeGauge,
+			}
+
+			metrics, err := parseMetrics(d, test.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(metrics) != 1 {
+				t.Fatalf("expected 1 metric but got %v", len(metrics))
+			}
+
+			label := test.label
+			if label == "" {
+				label = "value"
+			}
+			m := metrics[0]
+			if m.Value != 1 || m.Labels[label] != test.expected || m.Labels["vendor"] != "acme" {
+				t.Fatalf("expected %v=%q with value 1 but got %v with value %v", label, test.expected, m.Labels, m.Value)
+			}
+		})
+	}
+}
+
+func TestConvertByteOrder(t *testing.T) {
+	two := []byte{1, 2, 3, 4}
+	three := []byte{1, 2, 3, 4, 5, 6}
+	four := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+
+	for _, test := range []struct {
+		name     string
+		def      config.MetricDef
+		input    []byte
+		expected []byte
+	}{
+		{"default", config.MetricDef{}, two, []byte{1, 2, 3, 4}},
+		{"big", config.MetricDef{Endianness: config.EndiannessBigEndian}, two, []byte{1, 2, 3, 4}},
+		{"little", config.MetricDef{Endianness: config.EndiannessLittleEndian}, two, []byte{4, 3, 2, 1}},
+		{"mixed", config.MetricDef{Endianness: config.EndiannessMixedEndian}, two, []byte{2, 1, 4, 3}},
+		{"yolo", config.MetricDef{Endianness: config.EndiannessYolo}, two, []byte{3, 4, 1, 2}},
+		{"16 bit little", config.MetricDef{Endianness: config.EndiannessLittleEndian}, []byte{1, 2}, []byte{2, 1}},
+		{"16 bit byteOrder little", config.MetricDef{ByteOrder: config.OrderLittle}, []byte{1, 2}, []byte{2, 1}},
+		{"byteOrder little", config.MetricDef{ByteOrder: config.OrderLittle}, two, []byte{2, 1, 4, 3}},
+		{"wordOrder little", config.MetricDef{WordOrder: config.OrderLittle}, two, []byte{3, 4, 1, 2}},
+		{"48 bit little", config.MetricDef{Endianness: config.EndiannessLittleEndian}, three, []byte{6, 5, 4, 3, 2, 1}},
+		{"48 bit mixed", config.MetricDef{Endianness: config.EndiannessMixedEndian}, three, []byte{2, 1, 4, 3, 6, 5}},
+		{"48 bit yolo", config.MetricDef{Endianness: config.EndiannessYolo}, three, []byte{5, 6, 3, 4, 1, 2}},
+		{"64 bit little", config.MetricDef{Endianness: config.EndiannessLittleEndian}, four, []byte{8, 7, 6, 5, 4, 3, 2, 1}},
+		{"64 bit mixed", config.MetricDef{Endianness: config.EndiannessMixedEndian}, four, []byte{2, 1, 4, 3, 6, 5, 8, 7}},
+		{"64 bit yolo", config.MetricDef{Endianness: config.EndiannessYolo}, four, []byte{7, 8, 5, 6, 3, 4, 1, 2}},
+		{
+			"64 bit wordOrder little, registerOrder big",
+			config.MetricDef{WordOrder: config.OrderLittle, RegisterOrder: config.OrderBig},
+			four, []byte{5, 6, 7, 8, 1, 2, 3, 4},
+		},
+		{
+			"64 bit registerOrder little",
+			config.MetricDef{RegisterOrder: config.OrderLittle},
+			four, []byte{3, 4, 1, 2, 7, 8, 5, 6},
+		},
+		{
+			"64 bit byteOrder little, registerOrder little",
+			config.MetricDef{ByteOrder: config.OrderLittle, RegisterOrder: config.OrderLittle},
+			four, []byte{4, 3, 2, 1, 8, 7, 6, 5},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := convertByteOrder(test.def, test.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, test.expected) {
+				t.Fatalf("expected %v but got %v", test.expected, got)
+			}
+		})
+	}
+
+	if _, err := convertByteOrder(config.MetricDef{}, []byte{1, 2, 3}); err == nil {
+		t.Fatal("expected error with odd number of bytes")
+	}
+}
+
+func TestParseModbusDataBCD(t *testing.T) {
+	factor := 0.5
+	for _, test := range []struct {
+		name       string
+		dataType   config.ModbusDataType
+		endianness config.EndiannessType
+		factor     *float64
+		input      []byte
+		expected   float64
+	}{
+		{"bcd16", config.ModbusBCD16, config.EndiannessBigEndian, nil, []byte{0x12, 0x34}, 1234},
+		{"bcd16 little endian", config.ModbusBCD16, config.EndiannessLittleEndian, nil, []byte{0x34, 0x12}, 1234},
+		{"bcd16 factor", config.ModbusBCD16, config.EndiannessBigEndian, &factor, []byte{0x99, 0x99}, 4999.5},
+		{"bcd32", config.ModbusBCD32, config.EndiannessBigEndian, nil, []byte{0x12, 0x34, 0x56, 0x78}, 12345678},
+		{"bcd32 yolo", config.ModbusBCD32, config.EndiannessYolo, nil, []byte{0x56, 0x78, 0x12, 0x34}, 12345678},
+		{"bcd64", config.ModbusBCD64, config.EndiannessBigEndian, nil, []byte{0x00, 0x00, 0x00, 0x01, 0x23, 0x45, 0x67, 0x89}, 123456789},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			def := config.MetricDef{
+				DataType:   test.dataType,
+				Endianness: test.endianness,
+				Factor:     test.factor,
+			}
+
+			v, err := parseModbusData(def, test.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v != test.expected {
+				t.Fatalf("expected %v but got %v", test.expected, v)
+			}
+		})
+	}
+}
+
+func TestParseModbusDataNRegisters(t *testing.T) {
+	offset := 44
+	for _, test := range []struct {
+		name       string
+		dataType   config.ModbusDataType
+		length     int
+		endianness config.EndiannessType
+		bitOffset  *int
+		bitLength  int
+		input      []byte
+		expected   float64
+	}{
+		{"uint48", config.ModbusUInt48, 0, config.EndiannessBigEndian, nil, 0, []byte{0x00, 0x01, 0x00, 0x00, 0x00, 0x02}, 1<<32 + 2},
+		{"uint48 max", config.ModbusUInt48, 0, config.EndiannessBigEndian, nil, 0, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}, 1<<48 - 1},
+		{"int48 negative", config.ModbusInt48, 0, config.EndiannessBigEndian, nil, 0, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xfe}, -2},
+		{"int48 positive", config.ModbusInt48, 0, config.EndiannessBigEndian, nil, 0, []byte{0x7f, 0xff, 0xff, 0xff, 0xff, 0xff}, 1<<47 - 1},
+		{"uint48 yolo", config.ModbusUInt48, 0, config.EndiannessYolo, nil, 0, []byte{0x00, 0x02, 0x00, 0x00, 0x00, 0x01}, 1<<32 + 2},
+		{"uint48 little endian", config.ModbusUInt48, 0, config.EndiannessLittleEndian, nil, 0, []byte{0x02, 0x00, 0x00, 0x00, 0x01, 0x00}, 1<<32 + 2},
+		{"uint48 mixed", config.ModbusUInt48, 0, config.EndiannessMixedEndian, nil, 0, []byte{0x01, 0x00, 0x00, 0x00, 0x02, 0x00}, 1<<32 + 2},
+		{"int48 bit field", config.ModbusInt48, 0, config.EndiannessBigEndian, &offset, 4, []byte{0xa0, 0x00, 0x00, 0x00, 0x00, 0x00}, -6},
+		{"uint one register", config.ModbusUInt, 1, config.EndiannessBigEndian, nil, 0, []byte{0xff, 0xfe}, 0xfffe},
+		{"int one register", config.ModbusInt, 1, config.EndiannessBigEndian, nil, 0, []byte{0xff, 0xfe}, -2},
+		{"int four registers", config.ModbusInt, 4, config.EndiannessBigEndian, nil, 0, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfd}, -3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			def := config.MetricDef{
+				DataType:   test.dataType,
+				Length:     test.length,
+				Endianness: test.endianness,
+				BitOffset:  test.bitOffset,
+				BitLength:  test.bitLength,
+			}
+
+			v, err := parseModbusData(def, test.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v != test.expected {
+				t.Fatalf("expected %v but got %v", test.expected, v)
+			}
+		})
+	}
+}
+
+func TestParseModbusDataEncoding(t *testing.T) {
+	offset := 4
+	for _, test := range []struct {
+		name      string
+		dataType  config.ModbusDataType
+		encoding  config.IntegerEncoding
+		bitOffset *int
+		bitLength int
+		input     []byte
+		expected  float64
+	}{
+		{"int16 sign magnitude negative", config.ModbusInt16, config.EncodingSignMagnitude, nil, 0, []byte{0x80, 0x0a}, -10},
+		{"int16 sign magnitude positive", config.ModbusInt16, config.EncodingSignMagnitude, nil, 0, []byte{0x00, 0x0a}, 10},
+		{"int16 sign magnitude negative zero", config.ModbusInt16, config.EncodingSignMagnitude, nil, 0, []byte{0x80, 0x00}, 0},
+		{"int16 ones complement negative", config.ModbusInt16, config.EncodingOnesComplement, nil, 0, []byte{0xff, 0xf5}, -10},
+		{"int16 ones complement positive", config.ModbusInt16, config.EncodingOnesComplement, nil, 0, []byte{0x00, 0x0a}, 10},
+		{"int16 twos complement", config.ModbusInt16, config.EncodingTwosComplement, nil, 0, []byte{0xff, 0xf6}, -10},
+		{"int32 sign magnitude", config.ModbusInt32, config.EncodingSignMagnitude, nil, 0, []byte{0x80, 0x01, 0x00, 0x00}, -65536},
+		{"int32 ones complement", config.ModbusInt32, config.EncodingOnesComplement, nil, 0, []byte{0xff, 0xfe, 0xff, 0xff}, -65536},
+		{"int64 sign magnitude", config.ModbusInt64, config.EncodingSignMagnitude, nil, 0, []byte{0x80, 0, 0, 0, 0, 0, 0, 0x02}, -2},
+		{"int64 ones complement", config.ModbusInt64, config.EncodingOnesComplement, nil, 0, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfd}, -2},
+		{"int16 bit field sign magnitude", config.ModbusInt16, config.EncodingSignMagnitude, &offset, 4, []byte{0x00, 0xb0}, -3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			def := config.MetricDef{
+				DataType:  test.dataType,
+				Encoding:  test.encoding,
+				BitOffset: test.bitOffset,
+				BitLength: test.bitLength,
+			}
+
+			v, err := parseModbusData(def, test.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v != test.expected {
+				t.Fatalf("expected %v but got %v", test.expected, v)
+			}
+		})
+	}
+}
+
+func TestParseModbusData8Bit(t *testing.T) {
+	for _, test := range []struct {
+		name       string
+		dataType   config.ModbusDataType
+		byte       config.ByteSelector
+		endianness config.EndiannessType
+		expected   float64
+	}{
+		{"uint8 high", config.ModbusUInt8, config.ByteHigh, config.EndiannessBigEndian, 0x17},
+		{"uint8 low", config.ModbusUInt8, config.ByteLow, config.EndiannessBigEndian, 0xfe},
+		{"int8 high", config.ModbusInt8, config.ByteHigh, config.EndiannessBigEndian, 0x17},
+		{"int8 low", config.ModbusInt8, config.ByteLow, config.EndiannessBigEndian, -2},
+		{"uint8 high little endian", config.ModbusUInt8, config.ByteHigh, config.EndiannessLittleEndian, 0xfe},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			def := config.MetricDef{
+				DataType:   test.dataType,
+				Byte:       test.byte,
+				Endianness: test.endianness,
+			}
+
+			v, err := parseModbusData(def, []byte{0x17, 0xfe})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v != test.expected {
+				t.Fatalf("expected %v but got %v", test.expected, v)
+			}
+		})
+	}
+}
+
+func TestParseModbusDataBitField(t *testing.T) {
+	offset := func(o int) *int { return &o }
+	for _, test := range []struct {
+		name      string
+		dataType  config.ModbusDataType
+		bitOffset *int
+		bitLength int
+		input     []byte
+		expected  float64
+	}{
+		{"uint16 low bits", config.ModbusUInt16, nil, 3, []byte{0xff, 0xf5}, 5},
+		{"uint16 middle bits", config.ModbusUInt16, offset(4), 4, []byte{0x0a, 0xb0}, 0xb},
+		{"uint16 top bits", config.ModbusUInt16, offset(14), 2, []byte{0xc0, 0x00}, 3},
+		{"int16 negative field", config.ModbusInt16, offset(4), 4, []byte{0x00, 0xb0}, -5},
+		{"int16 positive field", config.ModbusInt16, offset(4), 4, []byte{0x00, 0x70}, 7},
+		{"uint32 across registers", config.ModbusUInt32, offset(14), 4, []byte{0x00, 0x02, 0xc0, 0x00}, 0xb},
+		{"int32 negative field", config.ModbusInt32, offset(16), 2, []byte{0x00, 0x02, 0x00, 0x00}, -2},
+		{"uint64 top bits", config.ModbusUInt64, offset(60), 4, []byte{0xf0, 0, 0, 0, 0, 0, 0, 0}, 15},
+		{"int64 whole", config.ModbusInt64, nil, 64, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe}, -2},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			def := config.MetricDef{
+				DataType:  test.dataType,
+				BitOffset: test.bitOffset,
+				BitLength: test.bitLength,
+			}
+
+			v, err := parseModbusData(def, test.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v != test.expected {
+				t.Fatalf("expected %v but got %v", test.expected, v)
+			}
+		})
+	}
+}
+
+func TestParseMetricsInvalidBCD(t *testing.T) {
+	s := mbserver.NewServer()
+	s.HoldingRegisters[10] = 0x12A4
+
+	address := listenTCP(t, func(conn net.Conn) {
+		serveMBAP(s, conn)
+	})
+
+	exporter := NewExporter(config.Config{
+		Modules: []config.Module{
+			{
+				Name:     "bcd",
+				Protocol: config.ModbusProtocolTCPIP,
+				Timeout:  1000,
+				Metrics: []config.MetricDef{
+					{Name: "energy", Address: 300010, DataType: config.ModbusBCD16, MetricType: config.MetricTypeCounter},
+				},
+			},
+		},
+	}, log.NewNopLogger())
+
+	_, err := exporter.Scrape(address, 1, "bcd")
+	if err == nil {
+		t.Fatal("expected scrape to fail with invalid BCD digit")
+	}
+	if !strings.Contains(err.Error(), "metric 'energy'") || !strings.Contains(err.Error(), "invalid BCD digit A") {
+		t.Fatalf("expected error naming the metric and the invalid digit but got: %v", err)
+	}
+}
+
+func TestScrapeExpressions(t *testing.T) {
+	s := mbserver.NewServer()
+	s.HoldingRegisters[10] = 212
+	s.HoldingRegisters[11] = 3
+	s.HoldingRegisters[12] = 4
+	s.HoldingRegisters[13] = 0x8000 // not implemented scale factor
+
+	address := listenTCP(t, func(conn net.Conn) {
+		serveMBAP(s, conn)
+	})
+
+	ten := 10.0
+	exporter := NewExporter(config.Config{
+		Modules: []config.Module{
+			{
+				Name:     "expr",
+				Protocol: config.ModbusProtocolTCPIP,
+				Timeout:  1000,
+				Metrics: []config.MetricDef{
+					{Name: "celsius", Address: 300010, DataType: config.ModbusUInt16, Expr: "(x - 32) * 5 / 9", MetricType: config.MetricTypeGauge},
+					{Name: "active", Address: 300011, DataType: config.ModbusUInt16, Factor: &ten, MetricType: config.MetricTypeGauge},
+					// References see the value of active before its own
+					// expression.
+					{Name: "apparent", Address: 300012, DataType: config.ModbusUInt16, Expr: "sqrt(active^2 + (x * 10)^2)", MetricType: config.MetricTypeGauge},
+					// raw is the value before factor.
+					{Name: "scaled", Address: 300011, DataType: config.ModbusUInt16, Factor: &ten, Expr: "x + raw", MetricType: config.MetricTypeGauge},
+					{Name: "missing", Address: 300012, DataType: config.ModbusUInt16, ScaleFactorAddress: 300013, MetricType: config.MetricTypeGauge},
+					{Name: "dependent", Address: 300012, DataType: config.ModbusUInt16, Expr: "x + missing", MetricType: config.MetricTypeGauge},
+				},
+			},
+		},
+	}, log.NewNopLogger())
+
+	g, err := exporter.Scrape(address, 1, "expr")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]float64{"celsius": 100, "active": 30, "apparent": 50, "scaled": 33} {
+		if v := gatheredValue(t, g, name); v != expected {
+			t.Errorf("expected %v to be %v but got %v", name, expected, v)
+		}
+	}
+
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() == "dependent" {
+			t.Errorf("expected sample referencing a dropped sample to be dropped")
+		}
+	}
+}
+
+func TestScrapeDerived(t *testing.T) {
+	s := mbserver.NewServer()
+	s.HoldingRegisters[10] = 100
+	s.HoldingRegisters[11] = 200
+	s.HoldingRegisters[12] = 300
+	s.HoldingRegisters[13] = 750
+	s.HoldingRegisters[14] = 0x8000 // not implemented scale factor
+
+	address := listenTCP(t, func(conn net.Conn) {
+		serveMBAP(s, conn)
+	})
+
+	exporter := NewExporter(config.Config{
+		Modules: []config.Module{
+			{
+				Name:     "derived",
+				Protocol: config.ModbusProtocolTCPIP,
+				Timeout:  1000,
+				Metrics: []config.MetricDef{
+					{Name: "power_l1", Address: 300010, DataType: config.ModbusUInt16, MetricType: config.MetricTypeGauge},
+					{Name: "power_l2", Address: 300011, DataType: config.ModbusUInt16, MetricType: config.MetricTypeGauge},
+					{Name: "power_l3", Address: 300012, DataType: config.ModbusUInt16, MetricType: config.MetricTypeGauge},
+					{Name: "apparent_power", Address: 300013, DataType: config.ModbusUInt16, Expr: "x * 2", MetricType: config.MetricTypeGauge},
+					{Name: "missing", Address: 300013, DataType: config.ModbusUInt16, ScaleFactorAddress: 300014, MetricType: config.MetricTypeGauge},
+				},
+				Derived: []config.DerivedMetricDef{
+					{Name: "power_factor", Expr: "power_total / apparent_power", MetricType: config.MetricTypeGauge},
+					{Name: "power_total", Expr: "power_l1 + power_l2 + power_l3", Labels: map[string]string{"phase": "all"}, MetricType: config.MetricTypeGauge},
+					{Name: "dependent", Expr: "missing + 1", MetricType: config.MetricTypeGauge},
+				},
+			},
+		},
+	}, log.NewNopLogger())
+
+	g, err := exporter.Scrape(address, 1, "derived")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Derived metrics see the values of metrics after their expressions.
+	for name, expected := range map[string]float64{"power_total": 600, "power_factor": 0.4} {
+		if v := gatheredValue(t, g, name); v != expected {
+			t.Errorf("expected %v to be %v but got %v", name, expected, v)
+		}
+	}
+
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		switch mf.GetName() {
+		case "power_total":
+			labels := map[string]string{}
+			for _, l := range mf.GetMetric()[0].GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			if labels["phase"] != "all" || labels["module"] != "derived" {
+				t.Errorf("expected labels phase and module but got %v", labels)
+			}
+		case "dependent":
+			t.Errorf("expected derived metric referencing a dropped sample to be dropped")
+		}
+	}
+}
+
+func TestCalibrate(t *testing.T) {
+	// Strapping table of a horizontal tank, litres per level in mm.
+	points := []config.CalibrationPoint{{Raw: 0, Value: 0}, {Raw: 100, Value: 50}, {Raw: 200, Value: 250}, {Raw: 400, Value: 450}}
+
+	tests := []struct {
+		name       string
+		outOfRange config.OutOfRange
+		raw        float64
+		expected   float64
+		inRange    bool
+	}{
+		{"first point", "", 0, 0, true},
+		{"first segment", "", 50, 25, true},
+		{"inner point", "", 100, 50, true},
+		{"second segment", "", 150, 150, true},
+		{"last point", "", 400, 450, true},
+		{"clamp below", config.OutOfRangeClamp, -10, 0, false},
+		{"clamp above", "", 500, 450, false},
+		{"extrapolate below", config.OutOfRangeExtrapolate, -10, -5, false},
+		{"extrapolate above", config.OutOfRangeExtrapolate, 500, 550, false},
+		{"drop", config.OutOfRangeDrop, 500, 450, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			d := config.MetricDef{Calibration: points, CalibrationOutOfRange: test.outOfRange}
+
+			v, inRange := calibrate(d, test.raw)
+			if v != test.expected || inRange != test.inRange {
+				t.Fatalf("expected %v (in range %v) but got %v (in range %v)", test.expected, test.inRange, v, inRange)
+			}
+		})
+	}
+}
+
+func TestParseMetricsCalibration(t *testing.T) {
+	two := 2.0
+	d := config.MetricDef{
+		Name:                  "level",
+		DataType:              config.ModbusUInt16,
+		Factor:                &two,
+		Calibration:           []config.CalibrationPoint{{Raw: 0, Value: 100}, {Raw: 1000, Value: 0}},
+		CalibrationOutOfRange: config.OutOfRangeDrop,
+		MetricType:            config.MetricTypeGauge,
+	}
+
+	// The calibration is applied after the factor.
+	metrics, err := parseMetrics(d, []byte{0x00, 0xfa})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 1 || metrics[0].Value != 50 {
+		t.Fatalf("expected value 50 but got %v", metrics)
+	}
+
+	metrics, err = parseMetrics(d, []byte{0x01, 0xf5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(metrics) != 0 {
+		t.Fatalf("expected value out of range to be dropped but got %v", metrics)
+	}
+}
+
+func TestIsInvalid(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+
+	tests := []struct {
+		name       string
+		definition config.MetricDef
+		raw        float64
+		expected   bool
+	}{
+		{"no invalid values", config.MetricDef{}, -32768, false},
+		{"invalid value", config.MetricDef{InvalidValues: []float64{65535, -32768}}, -32768, true},
+		{"valid value", config.MetricDef{InvalidValues: []float64{65535, -32768}}, 32768, false},
+		{"invalid NaN", config.MetricDef{InvalidValues: []float64{math.NaN()}}, math.NaN(), true},
+		{"below range", config.MetricDef{ValidRange: &config.ValueRange{Min: f(0), Max: f(100)}}, -1, true},
+		{"within range", config.MetricDef{ValidRange: &config.ValueRange{Min: f(0), Max: f(100)}}, 100, false},
+		{"above open range", config.MetricDef{ValidRange: &config.ValueRange{Max: f(100)}}, 101, true},
+		{"NaN outside of range", config.MetricDef{ValidRange: &config.ValueRange{Min: f(0)}}, math.NaN(), true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isInvalid(test.definition, test.raw); got != test.expected {
+				t.Fatalf("expected %v but got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestScrapeInvalidValues(t *testing.T) {
+	s := mbserver.NewServer()
+	s.HoldingRegisters[10] = 0x8000
+	s.HoldingRegisters[11] = 0xffff
+	s.HoldingRegisters[12] = 42
+	s.HoldingRegisters[13] = 0xffff
+
+	address := listenTCP(t, func(conn net.Conn) {
+		serveMBAP(s, conn)
+	})
+
+	ten, hundred, thousand := 10.0, 100.0, 1000.0
+	metrics := []config.MetricDef{
+		{Name: "temperature", Address: 300010, DataType: config.ModbusInt16, InvalidValues: []float64{-32768}, MetricType: config.MetricTypeGauge},
+		// The range applies to the value before the factor.
+		{Name: "humidity", Address: 300011, DataType: config.ModbusUInt16, Factor: &ten, ValidRange: &config.ValueRange{Max: &thousand}, MetricType: config.MetricTypeGauge},
+		{Name: "pressure", Address: 300012, DataType: config.ModbusUInt16, Factor: &ten, ValidRange: &config.ValueRange{Max: &hundred}, MetricType: config.MetricTypeGauge},
+		{Name: "mode", Address: 300013, DataType: config.ModbusUInt16, InvalidValues: []float64{65535}, Enum: map[int64]string{0: "off"}, MetricType: config.MetricTypeGauge},
+	}
+	exporter := NewExporter(config.Config{
+		Modules: []config.Module{
+			{Name: "drop", Protocol: config.ModbusProtocolTCPIP, Timeout: 1000, Metrics: metrics},
+			{Name: "nan", Protocol: config.ModbusProtocolTCPIP, Timeout: 1000, Metrics: metrics, InvalidValuePolicy: config.InvalidValueNaN},
+		},
+	}, log.NewNopLogger())
+
+	g, err := exporter.Scrape(address, 1, "drop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	mfs, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mfs) != 1 || mfs[0].GetName() != "pressure" || mfs[0].GetMetric()[0].GetGauge().GetValue() != 420 {
+		t.Fatalf("expected only pressure of 420 to be exported but got %v", mfs)
+	}
+
+	g, err = exporter.Scrape(address, 1, "nan")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"temperature", "humidity", "mode"} {
+		if v := gatheredValue(t, g, name); !math.IsNaN(v) {
+			t.Errorf("expected %v to be NaN but got %v", name, v)
+		}
+	}
+	mfs, err = g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, mf := range mfs {
+		if mf.GetName() != "mode" {
+			continue
+		}
+		// All states of an enum are NaN.
+		if len(mf.GetMetric()) != 2 {
+			t.Errorf("expected states off and unknown but got %v", mf.GetMetric())
+		}
+		for _, m := range mf.GetMetric() {
+			if v := m.GetGauge().GetValue(); !math.IsNaN(v) {
+				t.Errorf("expected state to be NaN but got %v", v)
+			}
+		}
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(exporter)
+	mfs, err = reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	suppressed := map[string]float64{}
+	for _, mf := range mfs {
+		if mf.GetName() != "modbus_suppressed_samples_total" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			labels := []string{}
+			for _, l := range m.GetLabel() {
+				labels = append(labels, l.GetValue())
+			}
+			suppressed[strings.Join(labels, "/")] = m.GetCounter().GetValue()
+		}
+	}
+	expected := map[string]float64{
+		"humidity/drop": 1, "temperature/drop": 1, "mode/drop": 1,
+		"humidity/nan": 1, "temperature/nan": 1, "mode/nan": 1,
+	}
+	if fmt.Sprint(suppressed) != fmt.Sprint(expected) {
+		t.Fatalf("expected suppressed samples %v but got %v", expected, suppressed)
+	}
+}
+
+func TestScaleValue(t *testing.T) {
+	f := func(v float64) *float64 { return &v }
+
+	tests := []struct {
+		name       string
+		definition config.MetricDef
+		raw        float64
+		expected   float64
+	}{
+		{"none", config.MetricDef{}, 42, 42},
+		{"factor", config.MetricDef{Factor: f(0.5)}, 42, 21},
+		{"offset", config.MetricDef{Offset: f(-273.5)}, 300, 26.5},
+		// The factor is applied before the offset.
+		{"factor and offset", config.MetricDef{Factor: f(0.5), Offset: f(-273.5)}, 600, 26.5},
+		// 4-20 mA input over a range of -50 to 150.
+		{
+			"transform",
+			config.MetricDef{Transform: &config.Transform{PreOffset: -4000, Factor: f(200), Divisor: f(16000), PostOffset: -50}},
+			12000, 50,
+		},
+		{"transform defaults", config.MetricDef{Transform: &config.Transform{PostOffset: 1}}, 42, 43},
+		// The scale factor folded into the factor is applied before the
+		// transform.
+		{
+			"factor before transform",
+			config.MetricDef{Factor: f(10), Transform: &config.Transform{PreOffset: -20, Divisor: f(4)}},
+			10, 20,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if v := scaleValue(test.definition, test.raw); v != test.expected {
+				t.Fatalf("expected %v but got %v", test.expected, v)
+			}
+		})
+	}
+}
+
 // TestRegisterMetricTwoMetricsSameName makes sure registerMetrics reuses a
 // registered metric in case there is a second one with the same name instead of
 // reregistering which would cause an exception.
@@ -0,0 +1,276 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/goburrow/modbus"
+)
+
+// readRequest is a single Modbus read request serving one or more metrics.
+type readRequest struct {
+	function uint8
+	address  uint16
+	quantity uint16
+	metrics  []plannedMetric
+}
+
+// plannedMetric locates a metric definition within the response to a read
+// request.
+type plannedMetric struct {
+	definition config.MetricDef
+	// index of the definition, to return metrics in their configured order.
+	index int
+	// offset and quantity in registers, or bits for coils and discrete
+	// inputs, relative to the start of the request.
+	offset   uint16
+	quantity uint16
+	// scaleFactor marks the register holding the scale factor of other
+	// metrics, which is not exported itself.
+	scaleFactor bool
+}
+
+// addressRange is an inclusive range of addresses read via one function code.
+type addressRange struct {
+	function uint8
+	from, to uint16
+}
+
+// planReads groups the metric definitions of the module into as few read
+// requests as possible. Definitions read via the same function code are merged
+// if their ranges overlap, are adjacent or are at most maxGap registers (or
+// bits) apart, as long as the request stays within the limits of the protocol
+// and the module and does not touch a forbidden range.
+func planReads(module *config.Module) ([]*readRequest, error) {
+	forbidden := make([]addressRange, 0, len(module.ForbiddenRanges))
+	for _, r := range module.ForbiddenRanges {
+		function, from, err := r.From.Parse()
+		if err != nil {
+			return nil, fmt.Errorf("forbidden range: %v", err)
+		}
+		_, to, err := r.To.Parse()
+		if err != nil {
+			return nil, fmt.Errorf("forbidden range: %v", err)
+		}
+		forbidden = append(forbidden, addressRange{function, from, to})
+	}
+
+	// isForbidden returns whether any address from start up to end, exclusive,
+	// is forbidden.
+	isForbidden := func(function uint8, start, end int) bool {
+		for _, r := range forbidden {
+			if r.function == function && start <= int(r.to) && int(r.from) < end {
+				return true
+			}
+		}
+		return false
+	}
+
+	maxQuantity := func(function uint8) int {
+		if isBitFunction(function) {
+			return config.MaxBitsPerRead
+		}
+		if module.MaxRegistersPerRequest > 0 {
+			return module.MaxRegistersPerRequest
+		}
+		return config.MaxRegistersPerRead
+	}
+
+	planned := make([]plannedMetric, 0, len(module.Metrics))
+	functions := make([]uint8, 0, len(module.Metrics))
+	addresses := make([]uint16, 0, len(module.Metrics))
+
+	for i, definition := range module.Metrics {
+		function, address, err := parseAddress(definition)
+		if err != nil {
+			return nil, err
+		}
+
+		quantity := registerCount(definition)
+		if int(quantity) > maxQuantity(function) {
+			return nil, fmt.Errorf("metric '%v' needs %v registers, more than the %v allowed per request",
+				definition.Name, quantity, maxQuantity(function))
+		}
+		if isForbidden(function, int(address), int(address)+int(quantity)) {
+			return nil, fmt.Errorf("metric '%v', address '%v': address is within a forbidden range",
+				definition.Name, definition.Address)
+		}
+
+		planned = append(planned, plannedMetric{
+			definition: definition,
+			index:      i,
+			quantity:   quantity,
+		})
+		functions = append(functions, function)
+		addresses = append(addresses, address)
+	}
+
+	// Scale factor registers are read in the same scrape as the metrics
+	// referencing them, once per address.
+	scaleFactors := map[config.RegisterAddr]bool{}
+	for _, definition := range module.Metrics {
+		if definition.ScaleFactorAddress == 0 || scaleFactors[definition.ScaleFactorAddress] {
+			continue
+		}
+		scaleFactors[definition.ScaleFactorAddress] = true
+
+		function, address, err := definition.ScaleFactorAddress.Parse()
+		if err != nil {
+			return nil, fmt.Errorf("metric '%v', scale factor address '%v': %v",
+				definition.Name, definition.ScaleFactorAddress, err)
+		}
+		if isForbidden(function, int(address), int(address)+1) {
+			return nil, fmt.Errorf("metric '%v', scale factor address '%v': address is within a forbidden range",
+				definition.Name, definition.ScaleFactorAddress)
+		}
+
+		planned = append(planned, plannedMetric{
+			definition: config.MetricDef{
+				Name:     "scale_factor",
+				Address:  definition.ScaleFactorAddress,
+				DataType: config.ModbusInt16,
+			},
+			index:       -1,
+			quantity:    1,
+			scaleFactor: true,
+		})
+		functions = append(functions, function)
+		addresses = append(addresses, address)
+	}
+
+	order := make([]int, len(planned))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		i, j := order[a], order[b]
+		if functions[i] != functions[j] {
+			return functions[i] < functions[j]
+		}
+		return addresses[i] < addresses[j]
+	})
+
+	requests := []*readRequest{}
+	var current *readRequest
+	for _, i := range order {
+		m := planned[i]
+		start, end := int(addresses[i]), int(addresses[i])+int(m.quantity)
+
+		if current == nil || current.function != functions[i] ||
+			start > current.end()+module.MaxGap ||
+			max(end, current.end())-int(current.address) > maxQuantity(current.function) ||
+			isForbidden(current.function, current.end(), start) {
+			current = &readRequest{
+				function: functions[i],
+				address:  addresses[i],
+			}
+			requests = append(requests, current)
+		}
+
+		m.offset = uint16(start - int(current.address))
+		if end > current.end() {
+			current.quantity = uint16(end - int(current.address))
+		}
+		current.metrics = append(current.metrics, m)
+	}
+
+	return requests, nil
+}
+
+// parseAddress splits the address of a metric definition into the function
+// code, given by the first digit, and the register address.
+func parseAddress(definition config.MetricDef) (uint8, uint16, error) {
+	function, address, err := definition.Address.Parse()
+	if err != nil {
+		return 0, 0, fmt.Errorf(
+			"metric: '%v', address '%v': metric address should be within the range of 10 - 465535."+
+				"'1xxxxx' for read coil / digital output, '2xxxxx' for read discrete inputs / digital input,"+
+				"'3xxxxx' read holding registers / analog output, '4xxxxx' read input registers / analog input: %v",
+			definition.Name, definition.Address, err,
+		)
+	}
+
+	return function, address, nil
+}
+
+// registerCount returns the number of registers, or bits for coils and
+// discrete inputs, needed for the given metric definition.
+func registerCount(definition config.MetricDef) uint16 {
+	if definition.DataType == config.ModbusBits {
+		return uint16(definition.BitCount)
+	}
+	return uint16(definition.RegisterCount())
+}
+
+// isBitFunction returns whether the function code reads coils or discrete
+// inputs, which are addressed and counted in bits instead of registers.
+func isBitFunction(function uint8) bool {
+	return function == 1 || function == 2
+}
+
+func (r *readRequest) end() int {
+	return int(r.address) + int(r.quantity)
+}
+
+// read sends the request via the given client.
+func (r *readRequest) read(c modbus.Client) ([]byte, error) {
+	var data []byte
+	var err error
+	switch r.function {
+	case 1:
+		data, err = c.ReadCoils(r.address, r.quantity)
+	case 2:
+		data, err = c.ReadDiscreteInputs(r.address, r.quantity)
+	case 3:
+		data, err = c.ReadHoldingRegisters(r.address, r.quantity)
+	case 4:
+		data, err = c.ReadInputRegisters(r.address, r.quantity)
+	default:
+		return nil, fmt.Errorf("unsupported function code %v", r.function)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	expected := int(r.quantity) * 2
+	if isBitFunction(r.function) {
+		expected = (int(r.quantity) + 7) / 8
+	}
+	if len(data) < expected {
+		return nil, &InsufficientRegistersError{fmt.Sprintf("expected %v bytes, got %v", expected, len(data))}
+	}
+
+	return data, nil
+}
+
+// slice returns the part of the response data belonging to the given metric,
+// as if it had been read on its own.
+func (r *readRequest) slice(data []byte, m plannedMetric) []byte {
+	if !isBitFunction(r.function) {
+		return data[m.offset*2 : (m.offset+m.quantity)*2]
+	}
+
+	// Bits are packed into bytes starting with the least significant bit.
+	bits := make([]byte, (m.quantity+7)/8)
+	for i := uint16(0); i < m.quantity; i++ {
+		bit := m.offset + i
+		if data[bit/8]&(1<<(bit%8)) != 0 {
+			bits[i/8] |= 1 << (i % 8)
+		}
+	}
+	return bits
+}
@@ -0,0 +1,361 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/go-kit/log"
+	"github.com/tbrandon/mbserver"
+)
+
+// plannedRead summarizes a readRequest for comparison in tests.
+type plannedRead struct {
+	function uint8
+	address  uint16
+	quantity uint16
+	metrics  []string
+}
+
+func summarizePlan(requests []*readRequest) []plannedRead {
+	summary := []plannedRead{}
+	for _, r := range requests {
+		p := plannedRead{r.function, r.address, r.quantity, nil}
+		for _, m := range r.metrics {
+			p.metrics = append(p.metrics, fmt.Sprintf("%v@%v", m.definition.Name, m.offset))
+		}
+		summary = append(summary, p)
+	}
+	return summary
+}
+
+func def(name string, address config.RegisterAddr, dataType config.ModbusDataType) config.MetricDef {
+	return config.MetricDef{Name: name, Address: address, DataType: dataType, MetricType: config.MetricTypeGauge}
+}
+
+func TestPlanReads(t *testing.T) {
+	tests := []struct {
+		name     string
+		module   config.Module
+		expected []plannedRead
+	}{
+		{
+			name: "adjacent registers",
+			module: config.Module{
+				Metrics: []config.MetricDef{
+					def("b", 300011, config.ModbusUInt32),
+					def("a", 300010, config.ModbusUInt16),
+					def("c", 300013, config.ModbusFloat64),
+				},
+			},
+			expected: []plannedRead{
+				{3, 10, 7, []string{"a@0", "b@1", "c@3"}},
+			},
+		},
+		{
+			name: "overlapping registers",
+			module: config.Module{
+				Metrics: []config.MetricDef{
+					def("a", 300010, config.ModbusUInt32),
+					def("b", 300011, config.ModbusUInt16),
+				},
+			},
+			expected: []plannedRead{
+				{3, 10, 2, []string{"a@0", "b@1"}},
+			},
+		},
+		{
+			name: "gap without maxGap",
+			module: config.Module{
+				Metrics: []config.MetricDef{
+					def("a", 300010, config.ModbusUInt16),
+					def("b", 300012, config.ModbusUInt16),
+				},
+			},
+			expected: []plannedRead{
+				{3, 10, 1, []string{"a@0"}},
+				{3, 12, 1, []string{"b@0"}},
+			},
+		},
+		{
+			name: "gap within maxGap",
+			module: config.Module{
+				MaxGap: 2,
+				Metrics: []config.MetricDef{
+					def("a", 300010, config.ModbusUInt16),
+					def("b", 300012, config.ModbusUInt16),
+					def("c", 300016, config.ModbusUInt16),
+				},
+			},
+			expected: []plannedRead{
+				{3, 10, 3, []string{"a@0", "b@2"}},
+				{3, 16, 1, []string{"c@0"}},
+			},
+		},
+		{
+			name: "function codes are not mixed",
+			module: config.Module{
+				MaxGap: 10,
+				Metrics: []config.MetricDef{
+					def("input", 400010, config.ModbusUInt16),
+					def("holding", 300010, config.ModbusUInt16),
+					def("coil", 100011, config.ModbusBool),
+					def("discrete", 200012, config.ModbusBool),
+				},
+			},
+			expected: []plannedRead{
+				{1, 11, 1, []string{"coil@0"}},
+				{2, 12, 1, []string{"discrete@0"}},
+				{3, 10, 1, []string{"holding@0"}},
+				{4, 10, 1, []string{"input@0"}},
+			},
+		},
+		{
+			name: "register limit",
+			module: config.Module{
+				MaxGap: 200,
+				Metrics: []config.MetricDef{
+					def("a", 30000, config.ModbusUInt16),
+					def("b", 300123, config.ModbusUInt32),
+					def("c", 300124, config.ModbusUInt16),
+				},
+			},
+			expected: []plannedRead{
+				{3, 0, 125, []string{"a@0", "b@123", "c@124"}},
+			},
+		},
+		{
+			name: "register limit exceeded",
+			module: config.Module{
+				MaxGap: 200,
+				Metrics: []config.MetricDef{
+					def("a", 30000, config.ModbusUInt16),
+					def("b", 300124, config.ModbusUInt32),
+				},
+			},
+			expected: []plannedRead{
+				{3, 0, 1, []string{"a@0"}},
+				{3, 124, 2, []string{"b@0"}},
+			},
+		},
+		{
+			name: "bit limit",
+			module: config.Module{
+				MaxGap: 2000,
+				Metrics: []config.MetricDef{
+					def("a", 10000, config.ModbusBool),
+					def("b", 101999, config.ModbusBool),
+					def("c", 102000, config.ModbusBool),
+				},
+			},
+			expected: []plannedRead{
+				{1, 0, 2000, []string{"a@0", "b@1999"}},
+				{1, 2000, 1, []string{"c@0"}},
+			},
+		},
+		{
+			name: "maxRegistersPerRequest",
+			module: config.Module{
+				MaxRegistersPerRequest: 4,
+				Metrics: []config.MetricDef{
+					def("a", 300010, config.ModbusUInt16),
+					def("b", 300011, config.ModbusUInt32),
+					def("c", 300013, config.ModbusUInt32),
+					def("d", 300015, config.ModbusUInt16),
+				},
+			},
+			expected: []plannedRead{
+				{3, 10, 3, []string{"a@0", "b@1"}},
+				{3, 13, 3, []string{"c@0", "d@2"}},
+			},
+		},
+		{
+			name: "maxRegistersPerRequest does not limit coils",
+			module: config.Module{
+				MaxRegistersPerRequest: 1,
+				Metrics: []config.MetricDef{
+					def("a", 10000, config.ModbusBool),
+					def("b", 10001, config.ModbusBool),
+				},
+			},
+			expected: []plannedRead{
+				{1, 0, 2, []string{"a@0", "b@1"}},
+			},
+		},
+		{
+			name: "gap across forbidden range",
+			module: config.Module{
+				MaxGap: 10,
+				ForbiddenRanges: []config.AddressRange{
+					{From: 300012, To: 300013},
+				},
+				Metrics: []config.MetricDef{
+					def("a", 300010, config.ModbusUInt16),
+					def("b", 300011, config.ModbusUInt16),
+					def("c", 300014, config.ModbusUInt16),
+				},
+			},
+			expected: []plannedRead{
+				{3, 10, 2, []string{"a@0", "b@1"}},
+				{3, 14, 1, []string{"c@0"}},
+			},
+		},
+		{
+			name: "forbidden range of other function code",
+			module: config.Module{
+				MaxGap: 10,
+				ForbiddenRanges: []config.AddressRange{
+					{From: 400012, To: 400013},
+				},
+				Metrics: []config.MetricDef{
+					def("a", 300010, config.ModbusUInt16),
+					def("b", 300014, config.ModbusUInt16),
+				},
+			},
+			expected: []plannedRead{
+				{3, 10, 5, []string{"a@0", "b@4"}},
+			},
+		},
+		{
+			name: "scale factor",
+			module: config.Module{
+				Metrics: []config.MetricDef{
+					{Name: "a", Address: 300010, DataType: config.ModbusInt16, ScaleFactorAddress: 300012},
+					{Name: "b", Address: 300011, DataType: config.ModbusUInt16, ScaleFactorAddress: 300012},
+					{Name: "c", Address: 300020, DataType: config.ModbusUInt16, ScaleFactorAddress: 400020},
+				},
+			},
+			expected: []plannedRead{
+				{3, 10, 3, []string{"a@0", "b@1", "scale_factor@2"}},
+				{3, 20, 1, []string{"c@0"}},
+				{4, 20, 1, []string{"scale_factor@0"}},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			requests, err := planReads(&test.module)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := summarizePlan(requests); fmt.Sprint(got) != fmt.Sprint(test.expected) {
+				t.Fatalf("expected plan %v but got %v", test.expected, got)
+			}
+		})
+	}
+}
+
+func TestPlanReadsErrors(t *testing.T) {
+	tests := map[string]config.Module{
+		"invalid function code": {
+			Metrics: []config.MetricDef{def("a", 500010, config.ModbusUInt16)},
+		},
+		"metric exceeds maxRegistersPerRequest": {
+			MaxRegistersPerRequest: 2,
+			Metrics:                []config.MetricDef{def("a", 300010, config.ModbusUInt64)},
+		},
+		"metric within forbidden range": {
+			ForbiddenRanges: []config.AddressRange{{From: 300012, To: 300020}},
+			Metrics:         []config.MetricDef{def("a", 300010, config.ModbusUInt64)},
+		},
+		"scale factor within forbidden range": {
+			ForbiddenRanges: []config.AddressRange{{From: 300012, To: 300020}},
+			Metrics: []config.MetricDef{
+				{Name: "a", Address: 300010, DataType: config.ModbusInt16, ScaleFactorAddress: 300012},
+			},
+		},
+	}
+
+	for name, module := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := planReads(&module); err == nil {
+				t.Fatal("expected planning to fail")
+			}
+		})
+	}
+}
+
+func TestReadRequestSliceBits(t *testing.T) {
+	r := &readRequest{function: 1, address: 0, quantity: 16}
+
+	// Bits 6 to 9 are 1, 0, 1, 1.
+	data := []byte{0b01000000, 0b00000011}
+	got := r.slice(data, plannedMetric{offset: 6, quantity: 4})
+	if !bytes.Equal(got, []byte{0b1101}) {
+		t.Fatalf("expected bits 1101 but got %b", got)
+	}
+}
+
+func TestScrapeCoalescesReads(t *testing.T) {
+	s := mbserver.NewServer()
+	s.HoldingRegisters[10] = 1
+	s.HoldingRegisters[11] = 2
+	s.HoldingRegisters[12] = 3
+
+	var requests int32
+	address := listenTCP(t, func(conn net.Conn) {
+		for {
+			request, err := readMBAPResponse(conn, nil)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&requests, 1)
+
+			frame, err := mbserver.NewTCPFrame(request)
+			if err != nil {
+				return
+			}
+			frame.Function, frame.Data = serverResponse(s, frame.Function, frame.Data)
+			if _, err := conn.Write(frame.Bytes()); err != nil {
+				return
+			}
+		}
+	})
+
+	exporter := NewExporter(config.Config{
+		Modules: []config.Module{
+			{
+				Name:     "coalesce",
+				Protocol: config.ModbusProtocolTCPIP,
+				Timeout:  1000,
+				Metrics: []config.MetricDef{
+					def("third", 300012, config.ModbusUInt16),
+					def("first", 300010, config.ModbusUInt16),
+					def("second", 300011, config.ModbusUInt16),
+				},
+			},
+		},
+	}, log.NewNopLogger())
+
+	g, err := exporter.Scrape(address, 1, "coalesce")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, expected := range map[string]float64{"first": 1, "second": 2, "third": 3} {
+		if v := gatheredValue(t, g, name); v != expected {
+			t.Errorf("expected %v to be %v but got %v", name, expected, v)
+		}
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("expected 1 request but got %v", n)
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/RichiH/modbus_exporter/config"
+)
+
+// maxConnectionsPerKey limits the connections to a target with the same
+// transport settings, as gateways often accept only a few. Further scrapes wait
+// for a connection to be handed back, up to the timeout of their module.
+const maxConnectionsPerKey = 1
+
+// connectionPool keeps connections to targets open across scrapes. A
+// connection is used by one scrape at a time and handed back to the pool once
+// the scrape is done.
+type connectionPool struct {
+	mtx  sync.Mutex
+	cond *sync.Cond
+	idle map[string][]*pooledConnection
+	// inUse counts the connections per key handed out and not yet handed
+	// back.
+	inUse        map[string]int
+	timer        *time.Timer
+	nextEviction time.Time
+}
+
+func newConnectionPool() *connectionPool {
+	p := &connectionPool{
+		idle:  map[string][]*pooledConnection{},
+		inUse: map[string]int{},
+	}
+	p.cond = sync.NewCond(&p.mtx)
+	return p
+}
+
+// connectionKey identifies the connections which can be shared by scrapes:
+// those to the same target via the same protocol and transport settings.
+// Modules with different credentials or serial settings never share a
+// connection.
+func connectionKey(module *config.Module, target string) string {
+	return fmt.Sprintf("%v://%v?timeout=%v&baudrate=%v&databits=%v&stopbits=%v&parity=%v&caFile=%q&certFile=%q&keyFile=%q&serverName=%q",
+		module.Protocol, target, module.Timeout,
+		module.Baudrate, module.Databits, module.Stopbits, module.Parity,
+		module.TLS.CAFile, module.TLS.CertFile, module.TLS.KeyFile, module.TLS.ServerName)
+}
+
+// pooledConnection is a connected transporter owned by the pool.
+type pooledConnection struct {
+	transporter
+
+	key       string
+	idleUntil time.Time
+
+	// sleepAfterConnect is applied when Send has to reconnect.
+	sleepAfterConnect time.Duration
+}
+
+// Send sends the request, reconnecting once if the connection turns out to be
+// closed by the remote end, e.g. because it was idle for too long.
+func (c *pooledConnection) Send(aduRequest []byte) ([]byte, error) {
+	aduResponse, err := c.transporter.Send(aduRequest)
+	if err == nil || !isConnectionClosed(err) {
+		return aduResponse, err
+	}
+
+	c.transporter.Close()
+	if err := c.transporter.Connect(); err != nil {
+		return nil, err
+	}
+	time.Sleep(c.sleepAfterConnect)
+
+	return c.transporter.Send(aduRequest)
+}
+
+// isConnectionClosed returns whether err signals that the remote end closed
+// the connection.
+func isConnectionClosed(err error) bool {
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, net.ErrClosed)
+}
+
+// get returns an idle connection for the given key or connects a new one
+// created by newTransporter. It waits up to timeout while maxConnectionsPerKey
+// connections are in use. The returned bool is true for new connections.
+func (p *connectionPool) get(key string, timeout time.Duration, newTransporter func() (transporter, error)) (*pooledConnection, bool, error) {
+	p.mtx.Lock()
+	if p.inUse[key] >= maxConnectionsPerKey {
+		expired := false
+		timer := time.AfterFunc(timeout, func() {
+			p.mtx.Lock()
+			defer p.mtx.Unlock()
+			expired = true
+			p.cond.Broadcast()
+		})
+		for p.inUse[key] >= maxConnectionsPerKey && !expired {
+			p.cond.Wait()
+		}
+		timer.Stop()
+
+		if p.inUse[key] >= maxConnectionsPerKey {
+			p.mtx.Unlock()
+			return nil, false, fmt.Errorf("timed out after %v waiting for the connection used by another scrape", timeout)
+		}
+	}
+	p.inUse[key]++
+
+	for len(p.idle[key]) > 0 {
+		// Reuse the most recently used connection, so that surplus ones
+		// expire.
+		idle := p.idle[key]
+		c := idle[len(idle)-1]
+		p.idle[key] = idle[:len(idle)-1]
+
+		if time.Now().Before(c.idleUntil) {
+			p.mtx.Unlock()
+			return c, false, nil
+		}
+		c.Close()
+	}
+	p.mtx.Unlock()
+
+	t, err := newTransporter()
+	if err != nil {
+		p.release(key)
+		return nil, false, err
+	}
+	if err := t.Connect(); err != nil {
+		p.release(key)
+		return nil, false, err
+	}
+
+	return &pooledConnection{transporter: t, key: key}, true, nil
+}
+
+// release allows the next scrape waiting for a connection with the given key
+// to proceed.
+func (p *connectionPool) release(key string) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	p.releaseLocked(key)
+}
+
+// releaseLocked is release for callers holding the lock.
+func (p *connectionPool) releaseLocked(key string) {
+	p.inUse[key]--
+	if p.inUse[key] <= 0 {
+		delete(p.inUse, key)
+	}
+	p.cond.Broadcast()
+}
+
+// put hands the connection back to the pool, which closes it once it was idle
+// for idleTimeout. A connection is closed right away if idleTimeout is not
+// positive.
+func (p *connectionPool) put(c *pooledConnection, idleTimeout time.Duration) {
+	if idleTimeout <= 0 {
+		c.Close()
+		p.release(c.key)
+		return
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.releaseLocked(c.key)
+	c.idleUntil = time.Now().Add(idleTimeout)
+	p.idle[c.key] = append(p.idle[c.key], c)
+	p.scheduleEviction(c.idleUntil)
+}
+
+// scheduleEviction makes sure evict runs no later than at. Callers must hold
+// the lock.
+func (p *connectionPool) scheduleEviction(at time.Time) {
+	if p.timer != nil {
+		if !at.Before(p.nextEviction) {
+			return
+		}
+		p.timer.Stop()
+	}
+
+	p.nextEviction = at
+	p.timer = time.AfterFunc(time.Until(at), p.evict)
+}
+
+// discard closes a connection that is in an unknown state, e.g. after a
+// timeout, instead of handing it back to the pool.
+func (p *connectionPool) discard(c *pooledConnection) {
+	c.Close()
+	p.release(c.key)
+}
+
+// evict closes all expired idle connections and schedules the next eviction
+// if there are idle connections left.
+func (p *connectionPool) evict() {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	now := time.Now()
+	var next time.Time
+	for key, idle := range p.idle {
+		kept := idle[:0]
+		for _, c := range idle {
+			if !now.Before(c.idleUntil) {
+				c.Close()
+				continue
+			}
+
+			kept = append(kept, c)
+			if next.IsZero() || c.idleUntil.Before(next) {
+				next = c.idleUntil
+			}
+		}
+
+		if len(kept) == 0 {
+			delete(p.idle, key)
+			continue
+		}
+		p.idle[key] = kept
+	}
+
+	p.timer = nil
+	if !next.IsZero() {
+		p.scheduleEviction(next)
+	}
+}
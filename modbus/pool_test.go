@@ -0,0 +1,371 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tbrandon/mbserver"
+)
+
+// fakeTransporter counts how often it is connected and closed.
+type fakeTransporter struct {
+	mtx      sync.Mutex
+	connects int
+	closes   int
+}
+
+func (t *fakeTransporter) Send(aduRequest []byte) ([]byte, error) {
+	return aduRequest, nil
+}
+
+func (t *fakeTransporter) Connect() error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.connects++
+	return nil
+}
+
+func (t *fakeTransporter) Close() error {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.closes++
+	return nil
+}
+
+func (t *fakeTransporter) closed() int {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.closes
+}
+
+func newPoolTestExporter(protocol config.ModbusProtocol, sleepAfterConnect time.Duration) *Exporter {
+	return NewExporter(config.Config{
+		Modules: []config.Module{
+			{
+				Name:     "pool",
+				Protocol: protocol,
+				Timeout:  1000,
+				Workarounds: config.Workarounds{
+					SleepAfterConnect: sleepAfterConnect,
+				},
+				Metrics: []config.MetricDef{
+					{
+						Name:       "holding",
+						Address:    300022,
+						DataType:   config.ModbusUInt16,
+						MetricType: config.MetricTypeGauge,
+					},
+				},
+			},
+		},
+	}, log.NewNopLogger())
+}
+
+func TestScrapeReusesConnection(t *testing.T) {
+	s := mbserver.NewServer()
+	s.HoldingRegisters[22] = 240
+
+	var accepted int32
+	address := listenTCP(t, func(conn net.Conn) {
+		atomic.AddInt32(&accepted, 1)
+		serveMBAP(s, conn)
+	})
+
+	exporter := newPoolTestExporter(config.ModbusProtocolTCPIP, 100*time.Millisecond)
+
+	for i, subTarget := range []byte{1, 2, 1} {
+		start := time.Now()
+		g, err := exporter.Scrape(address, subTarget, "pool")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v := gatheredValue(t, g, "holding"); v != 240 {
+			t.Fatalf("expected holding register value 240 but got %v", v)
+		}
+
+		// Only the first scrape establishes a connection.
+		if elapsed := time.Since(start); i > 0 && elapsed >= 100*time.Millisecond {
+			t.Fatalf("expected scrape %v not to sleep after connect but took %v", i, elapsed)
+		}
+	}
+
+	if n := atomic.LoadInt32(&accepted); n != 1 {
+		t.Fatalf("expected 1 connection but got %v", n)
+	}
+}
+
+func TestScrapeReconnectsClosedConnection(t *testing.T) {
+	s := mbserver.NewServer()
+	s.HoldingRegisters[22] = 240
+
+	var accepted int32
+	address := listenTCP(t, func(conn net.Conn) {
+		atomic.AddInt32(&accepted, 1)
+
+		// Answer a single request and hang up, like a gateway dropping
+		// idle connections.
+		request, err := readMBAPResponse(conn, nil)
+		if err != nil {
+			return
+		}
+		frame, err := mbserver.NewTCPFrame(request)
+		if err != nil {
+			return
+		}
+		frame.Function, frame.Data = serverResponse(s, frame.Function, frame.Data)
+		conn.Write(frame.Bytes())
+	})
+
+	exporter := newPoolTestExporter(config.ModbusProtocolTCPIP, 0)
+
+	for i := 0; i < 2; i++ {
+		g, err := exporter.Scrape(address, 1, "pool")
+		if err != nil {
+			t.Fatalf("scrape %v: %v", i, err)
+		}
+		if v := gatheredValue(t, g, "holding"); v != 240 {
+			t.Fatalf("expected holding register value 240 but got %v", v)
+		}
+	}
+
+	if n := atomic.LoadInt32(&accepted); n != 2 {
+		t.Fatalf("expected 2 connections but got %v", n)
+	}
+}
+
+func TestConnectionPool(t *testing.T) {
+	p := newConnectionPool()
+	ft := &fakeTransporter{}
+	newTransporter := func() (transporter, error) { return ft, nil }
+
+	c, fresh, err := p.get("a", time.Second, newTransporter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !fresh {
+		t.Fatal("expected a fresh connection from an empty pool")
+	}
+
+	p.put(c, time.Hour)
+
+	reused, fresh, err := p.get("a", time.Second, newTransporter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fresh || reused != c {
+		t.Fatal("expected the idle connection to be reused")
+	}
+
+	if _, fresh, _ := p.get("b", time.Second, newTransporter); !fresh {
+		t.Fatal("expected a fresh connection for a different key")
+	}
+
+	p.put(c, 10*time.Millisecond)
+	deadline := time.Now().Add(time.Second)
+	for ft.closed() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("expected idle connection to be closed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if _, fresh, _ := p.get("a", time.Second, newTransporter); !fresh {
+		t.Fatal("expected a fresh connection after the idle one was evicted")
+	}
+
+	p.put(c, -1)
+	if ft.closed() != 2 {
+		t.Fatal("expected connection to be closed right away with negative idle timeout")
+	}
+}
+
+func TestConnectionPoolLimit(t *testing.T) {
+	p := newConnectionPool()
+	newTransporter := func() (transporter, error) { return &fakeTransporter{}, nil }
+
+	c, _, err := p.get("a", time.Second, newTransporter)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(chan *pooledConnection)
+	go func() {
+		c, _, _ := p.get("a", time.Second, newTransporter)
+		got <- c
+	}()
+
+	select {
+	case <-got:
+		t.Fatal("expected second connection to wait for the first one")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	if _, _, err := p.get("a", 10*time.Millisecond, newTransporter); err == nil {
+		t.Fatal("expected waiting for the connection to time out")
+	}
+
+	p.put(c, time.Hour)
+	select {
+	case reused := <-got:
+		if reused != c {
+			t.Fatal("expected the connection handed back to be reused")
+		}
+		p.discard(reused)
+	case <-time.After(time.Second):
+		t.Fatal("expected waiting scrape to get the connection handed back")
+	}
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if len(p.inUse) != 0 {
+		t.Fatalf("expected no connections in use but got %v", p.inUse)
+	}
+}
+
+func TestConnectionKey(t *testing.T) {
+	module := config.Module{Name: "a", Protocol: config.ModbusProtocolTCPTLS, Timeout: 1000,
+		TLS: config.TLSConfig{CertFile: "a.crt", KeyFile: "a.key"}}
+
+	same := module
+	same.Name = "b"
+	if connectionKey(&module, "plc:802") != connectionKey(&same, "plc:802") {
+		t.Fatal("expected modules with the same transport settings to share connections")
+	}
+
+	for name, change := range map[string]func(m *config.Module){
+		"timeout":  func(m *config.Module) { m.Timeout = 2000 },
+		"certFile": func(m *config.Module) { m.TLS.CertFile = "b.crt" },
+		"caFile":   func(m *config.Module) { m.TLS.CAFile = "ca.crt" },
+		"baudrate": func(m *config.Module) { m.Baudrate = 9600 },
+		"parity":   func(m *config.Module) { m.Parity = "N" },
+	} {
+		other := module
+		change(&other)
+		if connectionKey(&module, "plc:802") == connectionKey(&other, "plc:802") {
+			t.Errorf("expected modules with different %v not to share connections", name)
+		}
+	}
+}
+
+func TestScrapeConcurrentSubTargets(t *testing.T) {
+	s := mbserver.NewServer()
+	address := listenTCP(t, func(conn net.Conn) {
+		serveMBAP(s, conn)
+	})
+
+	newExporter := func(timeout int, interlude time.Duration) *Exporter {
+		metrics := []config.MetricDef{}
+		// Addresses too far apart to be read together.
+		for _, address := range []config.RegisterAddr{300010, 300020, 300030} {
+			metrics = append(metrics, config.MetricDef{
+				Name:       fmt.Sprintf("holding_%v", address),
+				Address:    address,
+				DataType:   config.ModbusUInt16,
+				MetricType: config.MetricTypeGauge,
+			})
+		}
+
+		return NewExporter(config.Config{
+			Modules: []config.Module{
+				{
+					Name:     "pool",
+					Protocol: config.ModbusProtocolTCPIP,
+					Timeout:  timeout,
+					Workarounds: config.Workarounds{
+						ScrapeInterludeWait: interlude,
+					},
+					Metrics: metrics,
+				},
+			},
+		}, log.NewNopLogger())
+	}
+
+	scrapeConcurrently := func(exporter *Exporter) []error {
+		var wg sync.WaitGroup
+		errs := make([]error, 3)
+		for i := range errs {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, errs[i] = exporter.Scrape(address, byte(i+1), "pool")
+			}()
+		}
+		wg.Wait()
+		return errs
+	}
+
+	t.Run("scrapes wait for each other", func(t *testing.T) {
+		exporter := newExporter(2000, 50*time.Millisecond)
+		for _, err := range scrapeConcurrently(exporter) {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(exporter)
+		mfs, err := reg.Gather()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, mf := range mfs {
+			switch mf.GetName() {
+			case "modbus_request_queue_depth":
+				if v := mf.GetMetric()[0].GetGauge().GetValue(); v != 0 {
+					t.Errorf("expected empty queue but got depth %v", v)
+				}
+			case "modbus_request_queue_wait_seconds":
+				h := mf.GetMetric()[0].GetHistogram()
+				// 3 scrapes waiting for the connection and their 9
+				// transactions.
+				if h.GetSampleCount() != 12 {
+					t.Errorf("expected 12 observed waits but got %v", h.GetSampleCount())
+				}
+				// Each scrape sleeps 150ms, the second one waits
+				// for the first, the third one for both.
+				if h.GetSampleSum() < 0.4 {
+					t.Errorf("expected scrapes to wait for each other but waited %vs in total", h.GetSampleSum())
+				}
+			}
+		}
+	})
+
+	t.Run("waiting times out", func(t *testing.T) {
+		exporter := newExporter(100, 100*time.Millisecond)
+
+		failed := 0
+		for _, err := range scrapeConcurrently(exporter) {
+			if err != nil {
+				if !strings.Contains(err.Error(), "timed out") {
+					t.Fatal(err)
+				}
+				failed++
+			}
+		}
+		if failed == 0 {
+			t.Fatal("expected scrapes waiting longer than the module timeout to fail")
+		}
+	})
+}
@@ -0,0 +1,163 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"sync"
+	"time"
+
+	"github.com/goburrow/modbus"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// schedulerIdleTimeout is how long the queue of a target and its series are
+// kept after its last transaction. Targets come from the query string, so they
+// must not pile up forever.
+const schedulerIdleTimeout = 5 * time.Minute
+
+// requestScheduler queues Modbus transactions per target and sends them one at
+// a time. Many gateways, especially those bridging to serial lines, mix up
+// concurrent transactions, e.g. of scrapes of different sub targets.
+type requestScheduler struct {
+	mtx         sync.Mutex
+	queues      map[string]*targetQueue
+	idleTimeout time.Duration
+
+	queueDepth  *prometheus.GaugeVec
+	waitSeconds *prometheus.HistogramVec
+}
+
+// targetQueue lets one transaction to a target through at a time.
+type targetQueue struct {
+	ch       chan struct{}
+	users    int
+	lastUsed time.Time
+}
+
+func newRequestScheduler() *requestScheduler {
+	return &requestScheduler{
+		queues:      map[string]*targetQueue{},
+		idleTimeout: schedulerIdleTimeout,
+		queueDepth: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "modbus_request_queue_depth",
+			Help: "Number of scrapes and Modbus transactions waiting for a target to become available.",
+		}, []string{"target"}),
+		waitSeconds: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "modbus_request_queue_wait_seconds",
+			Help:    "Time scrapes and Modbus transactions waited for a target to become available.",
+			Buckets: []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10},
+		}, []string{"target"}),
+	}
+}
+
+// acquire blocks until no other transaction to the given target is in flight
+// and returns a function to release the target again.
+func (s *requestScheduler) acquire(target string) func() {
+	queue, waited := s.wait(target)
+	queue.ch <- struct{}{}
+	waited()
+
+	return func() {
+		<-queue.ch
+		s.leave(queue)
+	}
+}
+
+// track accounts a scrape waiting for a connection to the given target like a
+// queued transaction. It returns a function to call once the wait is over.
+func (s *requestScheduler) track(target string) func() {
+	queue, waited := s.wait(target)
+
+	return func() {
+		waited()
+		s.leave(queue)
+	}
+}
+
+// wait returns the queue of the given target and counts a waiter in the queue
+// depth until the returned function is called, which observes the time waited.
+// Callers must call leave once they are done with the queue.
+func (s *requestScheduler) wait(target string) (*targetQueue, func()) {
+	s.mtx.Lock()
+	s.pruneLocked()
+	queue, ok := s.queues[target]
+	if !ok {
+		queue = &targetQueue{ch: make(chan struct{}, 1)}
+		s.queues[target] = queue
+	}
+	// Queues in use are never pruned.
+	queue.users++
+	s.mtx.Unlock()
+
+	depth := s.queueDepth.WithLabelValues(target)
+	start := time.Now()
+	depth.Inc()
+
+	return queue, func() {
+		depth.Dec()
+		s.waitSeconds.WithLabelValues(target).Observe(time.Since(start).Seconds())
+	}
+}
+
+// leave marks the queue as no longer used by a caller of wait.
+func (s *requestScheduler) leave(queue *targetQueue) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	queue.users--
+	queue.lastUsed = time.Now()
+}
+
+// pruneLocked removes the queues and series of targets without transactions
+// for idleTimeout. s.mtx must be held.
+func (s *requestScheduler) pruneLocked() {
+	for target, queue := range s.queues {
+		if queue.users == 0 && time.Since(queue.lastUsed) >= s.idleTimeout {
+			delete(s.queues, target)
+			s.queueDepth.DeleteLabelValues(target)
+			s.waitSeconds.DeleteLabelValues(target)
+		}
+	}
+}
+
+// scheduledTransporter sends requests through a requestScheduler.
+type scheduledTransporter struct {
+	modbus.Transporter
+
+	scheduler *requestScheduler
+	target    string
+}
+
+// Send waits for the target to become available and sends the request.
+func (t *scheduledTransporter) Send(aduRequest []byte) ([]byte, error) {
+	release := t.scheduler.acquire(t.target)
+	defer release()
+
+	return t.Transporter.Send(aduRequest)
+}
+
+// Describe implements the prometheus.Collector interface.
+func (s *requestScheduler) Describe(ch chan<- *prometheus.Desc) {
+	s.queueDepth.Describe(ch)
+	s.waitSeconds.Describe(ch)
+}
+
+// Collect implements the prometheus.Collector interface.
+func (s *requestScheduler) Collect(ch chan<- prometheus.Metric) {
+	s.mtx.Lock()
+	s.pruneLocked()
+	s.mtx.Unlock()
+
+	s.queueDepth.Collect(ch)
+	s.waitSeconds.Collect(ch)
+}
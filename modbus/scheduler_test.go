@@ -0,0 +1,134 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// overlapTransporter fails if it is sent requests concurrently, like a gateway
+// mixing up transactions.
+type overlapTransporter struct {
+	inFlight int32
+}
+
+func (t *overlapTransporter) Send(aduRequest []byte) ([]byte, error) {
+	if atomic.AddInt32(&t.inFlight, 1) > 1 {
+		return nil, errors.New("concurrent transaction")
+	}
+	defer atomic.AddInt32(&t.inFlight, -1)
+
+	time.Sleep(5 * time.Millisecond)
+	return aduRequest, nil
+}
+
+func TestRequestScheduler(t *testing.T) {
+	s := newRequestScheduler()
+	gateway := &overlapTransporter{}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			// Scrapes via modules with different transport settings use
+			// their own connections to the same target.
+			transporter := &scheduledTransporter{Transporter: gateway, scheduler: s, target: "10.0.0.1:502"}
+			if _, err := transporter.Send([]byte{1}); err != nil {
+				errs <- err
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		t.Error(err)
+	}
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(s)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mf := range mfs {
+		m := mf.GetMetric()[0]
+		switch mf.GetName() {
+		case "modbus_request_queue_depth":
+			if v := m.GetGauge().GetValue(); v != 0 {
+				t.Errorf("expected empty queue but got depth %v", v)
+			}
+		case "modbus_request_queue_wait_seconds":
+			h := m.GetHistogram()
+			if h.GetSampleCount() != 10 {
+				t.Errorf("expected 10 observed waits but got %v", h.GetSampleCount())
+			}
+			// Nine transactions had to wait for at least one other.
+			if h.GetSampleSum() < (9 * 5 * time.Millisecond).Seconds() {
+				t.Errorf("expected transactions to wait for each other but waited %vs in total", h.GetSampleSum())
+			}
+		default:
+			t.Errorf("unexpected metric %v", mf.GetName())
+		}
+	}
+	if len(mfs) != 2 {
+		t.Errorf("expected 2 metric families but got %v", len(mfs))
+	}
+}
+
+func TestRequestSchedulerPrunesIdleTargets(t *testing.T) {
+	s := newRequestScheduler()
+	s.idleTimeout = 0
+
+	s.acquire("10.0.0.1:502")()
+	release := s.acquire("10.0.0.2:502")
+	defer release()
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(s)
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mf := range mfs {
+		for _, m := range mf.GetMetric() {
+			if target := m.GetLabel()[0].GetValue(); target != "10.0.0.2:502" {
+				t.Errorf("expected series of idle target %v to be removed from %v", target, mf.GetName())
+			}
+		}
+		if len(mf.GetMetric()) != 1 {
+			t.Errorf("expected series of the target in use in %v but got %v", mf.GetName(), len(mf.GetMetric()))
+		}
+	}
+
+	if len(mfs) != 2 {
+		t.Errorf("expected 2 metric families but got %v", len(mfs))
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if len(s.queues) != 1 {
+		t.Errorf("expected 1 queue but got %v", len(s.queues))
+	}
+}
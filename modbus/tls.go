@@ -0,0 +1,119 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/asn1"
+	"fmt"
+	"net"
+	"os"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+
+	"github.com/RichiH/modbus_exporter/config"
+)
+
+// tlsPort is the registered port of Modbus/TCP Security, used if the target
+// does not specify one.
+const tlsPort = "802"
+
+// roleOID identifies the role extension in Modbus/TCP Security certificates.
+var roleOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 50316, 802, 1}
+
+// newTLSConfig loads the certificates referenced by the given module settings.
+// They are read on every connection so that renewed certificates are picked up
+// without a restart.
+func newTLSConfig(c config.TLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client certificate: %v", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ServerName:   c.ServerName,
+		// Modbus/TCP Security requires TLS 1.2 or later.
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if c.CAFile != "" {
+		ca, err := os.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load CA certificate: %v", err)
+		}
+
+		tlsConfig.RootCAs = x509.NewCertPool()
+		if !tlsConfig.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in CA file %v", c.CAFile)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// dialTLS returns a dialFunc opening TLS connections with the given config.
+// The role the server certificate claims is logged for every new connection.
+func dialTLS(tlsConfig *tls.Config, logger log.Logger) dialFunc {
+	return func(address string, timeout time.Duration) (net.Conn, error) {
+		dialer := tls.Dialer{
+			NetDialer: &net.Dialer{Timeout: timeout},
+			Config:    tlsConfig,
+		}
+
+		conn, err := dialer.Dial("tcp", address)
+		if err != nil {
+			return nil, err
+		}
+
+		role, err := peerRole(conn.(*tls.Conn).ConnectionState().PeerCertificates[0])
+		if err != nil {
+			_ = level.Warn(logger).Log("msg", "invalid role extension in peer certificate", "target", address, "err", err)
+		} else {
+			_ = level.Info(logger).Log("msg", "established Modbus/TCP Security connection", "target", address, "role", role)
+		}
+
+		return conn, nil
+	}
+}
+
+// peerRole returns the role stored in the Modbus/TCP Security role extension
+// of the given certificate or an empty string if there is none.
+func peerRole(cert *x509.Certificate) (string, error) {
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(roleOID) {
+			continue
+		}
+
+		var role string
+		if _, err := asn1.Unmarshal(ext.Value, &role); err != nil {
+			return "", err
+		}
+		return role, nil
+	}
+
+	return "", nil
+}
+
+// withDefaultPort appends the given port to address if it has none.
+func withDefaultPort(address, port string) string {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return net.JoinHostPort(address, port)
+	}
+
+	return address
+}
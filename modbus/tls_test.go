@@ -0,0 +1,251 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/go-kit/log"
+	"github.com/tbrandon/mbserver"
+)
+
+// serveMBAP answers Modbus/TCP requests on rw until it is closed.
+func serveMBAP(s *mbserver.Server, rw io.ReadWriter) {
+	for {
+		// Requests are framed like responses.
+		request, err := readMBAPResponse(rw, nil)
+		if err != nil {
+			return
+		}
+
+		frame, err := mbserver.NewTCPFrame(request)
+		if err != nil {
+			return
+		}
+
+		frame.Function, frame.Data = serverResponse(s, frame.Function, frame.Data)
+		if _, err := rw.Write(frame.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+// testCert is a certificate with its private key.
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// newTestCert creates a certificate from template, signed by parent or
+// self-signed if parent is nil.
+func newTestCert(t *testing.T, template *x509.Certificate, parent *testCert) *testCert {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCert{cert, key}
+}
+
+// write stores certificate and key as PEM files in dir and returns their paths.
+func (c *testCert) write(t *testing.T, dir, name string) (string, string) {
+	t.Helper()
+
+	certFile := filepath.Join(dir, name+".crt")
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	der, err := x509.MarshalECPrivateKey(c.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(dir, name+".key")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func (c *testCert) tlsCertificate() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func TestScrapeTCPTLS(t *testing.T) {
+	dir := t.TempDir()
+
+	ca := newTestCert(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}, nil)
+	caFile, _ := ca.write(t, dir, "ca")
+
+	role, err := asn1.MarshalWithParams("Operator", "utf8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTestCert(t, &x509.Certificate{
+		SerialNumber:    big.NewInt(2),
+		Subject:         pkix.Name{CommonName: "plc"},
+		DNSNames:        []string{"plc.example.com"},
+		ExtKeyUsage:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		ExtraExtensions: []pkix.Extension{{Id: roleOID, Value: role}},
+	}, ca)
+
+	client := newTestCert(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "modbus_exporter"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, ca)
+	certFile, keyFile := client.write(t, dir, "client")
+
+	clientCAs := x509.NewCertPool()
+	clientCAs.AddCert(ca.cert)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{server.tlsCertificate()},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	s := mbserver.NewServer()
+	s.HoldingRegisters[22] = 240
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serveMBAP(s, conn)
+			}()
+		}
+	}()
+
+	module := config.Module{
+		Name:     "tls",
+		Protocol: config.ModbusProtocolTCPTLS,
+		Timeout:  1000,
+		TLS: config.TLSConfig{
+			CAFile:     caFile,
+			CertFile:   certFile,
+			KeyFile:    keyFile,
+			ServerName: "plc.example.com",
+		},
+		Metrics: []config.MetricDef{
+			{
+				Name:       "holding",
+				Address:    300022,
+				DataType:   config.ModbusUInt16,
+				MetricType: config.MetricTypeGauge,
+			},
+		},
+	}
+
+	var logs bytes.Buffer
+	exporter := NewExporter(config.Config{Modules: []config.Module{module}}, log.NewLogfmtLogger(log.NewSyncWriter(&logs)))
+
+	g, err := exporter.Scrape(l.Addr().String(), 1, "tls")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := gatheredValue(t, g, "holding"); v != 240 {
+		t.Fatalf("expected holding register value 240 but got %v", v)
+	}
+	if !strings.Contains(logs.String(), "role=Operator") {
+		t.Fatalf("expected the role of the peer to be logged but got: %v", logs.String())
+	}
+
+	t.Run("module with other credentials", func(t *testing.T) {
+		other := module
+		other.Name = "other"
+		other.TLS = config.TLSConfig{CertFile: filepath.Join(dir, "nonexistent.crt"), KeyFile: keyFile}
+		exporter := NewExporter(config.Config{Modules: []config.Module{module, other}}, log.NewNopLogger())
+
+		if _, err := exporter.Scrape(l.Addr().String(), 1, "tls"); err != nil {
+			t.Fatal(err)
+		}
+		// The pooled connection of the first module must not be reused.
+		if _, err := exporter.Scrape(l.Addr().String(), 1, "other"); err == nil {
+			t.Fatal("expected scrape to fail with the credentials of the other module")
+		}
+	})
+
+	t.Run("untrusted server", func(t *testing.T) {
+		module.TLS.CAFile = ""
+		exporter := NewExporter(config.Config{Modules: []config.Module{module}}, log.NewNopLogger())
+
+		if _, err := exporter.Scrape(l.Addr().String(), 1, "tls"); err == nil {
+			t.Fatal("expected scrape to fail without trusting the server certificate")
+		}
+	})
+}
+
+func TestWithDefaultPort(t *testing.T) {
+	for address, expected := range map[string]string{
+		"10.0.0.5":      "10.0.0.5:802",
+		"10.0.0.5:8802": "10.0.0.5:8802",
+		"plc":           "plc:802",
+		"[::1]:802":     "[::1]:802",
+	} {
+		if got := withDefaultPort(address, tlsPort); got != expected {
+			t.Errorf("expected %v to become %v but got %v", address, expected, got)
+		}
+	}
+}
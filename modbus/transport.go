@@ -0,0 +1,400 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/go-kit/log"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/goburrow/modbus"
+	"github.com/goburrow/serial"
+)
+
+// defaultTimeout is used if the module does not specify a timeout. Without it a
+// read on a silent serial bus would block forever.
+const defaultTimeout = 5 * time.Second
+
+// transporter is a modbus.Transporter whose connection is opened and closed
+// explicitly, so that it can be kept open across requests and scrapes.
+type transporter interface {
+	modbus.Transporter
+	Connect() error
+	Close() error
+}
+
+// newPackager returns the framing matching the protocol of the given module,
+// addressing the given sub target.
+func newPackager(module *config.Module, subTarget byte) modbus.Packager {
+	// Only the framing of the handlers is used, their transport is created
+	// separately by newTransporter.
+	switch module.Protocol {
+	case config.ModbusProtocolRTU, config.ModbusProtocolRTUOverTCP:
+		packager := modbus.NewRTUClientHandler("")
+		packager.SlaveId = subTarget
+		return packager
+	case config.ModbusProtocolASCII, config.ModbusProtocolASCIIOverTCP:
+		packager := modbus.NewASCIIClientHandler("")
+		packager.SlaveId = subTarget
+		return packager
+	default:
+		packager := modbus.NewTCPClientHandler("")
+		packager.SlaveId = subTarget
+		return packager
+	}
+}
+
+// newTransporter returns the transport matching the protocol of the given
+// module. For network protocols the target is a host:port pair, for serial
+// protocols it is the path of the serial device.
+func newTransporter(module *config.Module, targetAddress string, logger log.Logger) (transporter, error) {
+	timeout := time.Duration(module.Timeout) * time.Millisecond
+
+	switch module.Protocol {
+	case config.ModbusProtocolRTU:
+		handler := modbus.NewRTUClientHandler(targetAddress)
+		handler.Config = serialConfig(module, targetAddress)
+		return handler, nil
+	case config.ModbusProtocolASCII:
+		handler := modbus.NewASCIIClientHandler(targetAddress)
+		handler.Config = serialConfig(module, targetAddress)
+		return handler, nil
+	case config.ModbusProtocolRTUOverTCP:
+		return newNetTransporter(targetAddress, timeout, readRTUResponse), nil
+	case config.ModbusProtocolASCIIOverTCP:
+		return newNetTransporter(targetAddress, timeout, readASCIIResponse), nil
+	case config.ModbusProtocolUDP:
+		return newUDPTransporter(targetAddress, timeout), nil
+	case config.ModbusProtocolTCPTLS:
+		tlsConfig, err := newTLSConfig(module.TLS)
+		if err != nil {
+			return nil, err
+		}
+
+		t := newNetTransporter(withDefaultPort(targetAddress, tlsPort), timeout, readMBAPResponse)
+		t.dial = dialTLS(tlsConfig, logger)
+		return t, nil
+	default:
+		handler := modbus.NewTCPClientHandler(targetAddress)
+		if timeout != 0 {
+			handler.Timeout = timeout
+		}
+		return handler, nil
+	}
+}
+
+// asciiDataBits is the default number of data bits of Modbus ASCII, whose
+// frames consist of 7 bit characters. goburrow/serial defaults to 8.
+const asciiDataBits = 7
+
+// serialConfig returns the serial line settings of the given module for the
+// serial device at address.
+func serialConfig(module *config.Module, address string) serial.Config {
+	c := serial.Config{
+		Address:  address,
+		BaudRate: module.Baudrate,
+		DataBits: module.Databits,
+		StopBits: module.Stopbits,
+		Parity:   module.Parity,
+		Timeout:  defaultTimeout,
+	}
+	if c.DataBits == 0 && module.Protocol == config.ModbusProtocolASCII {
+		c.DataBits = asciiDataBits
+	}
+	if module.Timeout != 0 {
+		c.Timeout = time.Duration(module.Timeout) * time.Millisecond
+	}
+
+	return c
+}
+
+// responseReader reads a single response frame to the given request from r.
+type responseReader func(r io.Reader, aduRequest []byte) ([]byte, error)
+
+// dialFunc opens a stream connection to the given address.
+type dialFunc func(address string, timeout time.Duration) (net.Conn, error)
+
+// dialTCP opens a plain TCP connection.
+func dialTCP(address string, timeout time.Duration) (net.Conn, error) {
+	dialer := net.Dialer{Timeout: timeout}
+	return dialer.Dial("tcp", address)
+}
+
+// netTransporter implements the modbus.Transporter interface on top of a
+// stream connection for framings or transports goburrow/modbus does not offer.
+type netTransporter struct {
+	address      string
+	timeout      time.Duration
+	dial         dialFunc
+	readResponse responseReader
+
+	conn net.Conn
+}
+
+func newNetTransporter(address string, timeout time.Duration, readResponse responseReader) *netTransporter {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	return &netTransporter{
+		address:      address,
+		timeout:      timeout,
+		dial:         dialTCP,
+		readResponse: readResponse,
+	}
+}
+
+// Connect dials the target address.
+func (t *netTransporter) Connect() error {
+	if t.conn != nil {
+		return nil
+	}
+
+	conn, err := t.dial(t.address, t.timeout)
+	if err != nil {
+		return err
+	}
+	t.conn = conn
+
+	return nil
+}
+
+// Close closes the connection, if any.
+func (t *netTransporter) Close() error {
+	if t.conn == nil {
+		return nil
+	}
+
+	err := t.conn.Close()
+	t.conn = nil
+	return err
+}
+
+// Send writes the request and waits for the matching response.
+func (t *netTransporter) Send(aduRequest []byte) ([]byte, error) {
+	if t.conn == nil {
+		// Establish a new connection and close it when complete, like
+		// the goburrow/modbus transporters do.
+		if err := t.Connect(); err != nil {
+			return nil, err
+		}
+		defer t.Close()
+	}
+
+	if err := t.conn.SetDeadline(time.Now().Add(t.timeout)); err != nil {
+		return nil, err
+	}
+
+	if _, err := t.conn.Write(aduRequest); err != nil {
+		return nil, err
+	}
+
+	return t.readResponse(t.conn, aduRequest)
+}
+
+// readMBAPResponse reads a frame with a Modbus application protocol header,
+// whose length field counts the bytes following it.
+func readMBAPResponse(r io.Reader, aduRequest []byte) ([]byte, error) {
+	// Transaction id, protocol id, length and unit id.
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	length := int(binary.BigEndian.Uint16(header[4:]))
+	if length <= 1 || length > mbapMaxSize-6 {
+		return nil, fmt.Errorf("modbus: length in response header '%v' must be between 2 and '%v'", length, mbapMaxSize-6)
+	}
+
+	// The unit id is already part of the header.
+	adu := make([]byte, len(header)+length-1)
+	copy(adu, header)
+	if _, err := io.ReadFull(r, adu[len(header):]); err != nil {
+		return nil, err
+	}
+
+	return adu, nil
+}
+
+// readRTUResponse reads an RTU frame. RTU frames carry no length field, thus
+// the length is derived from the byte count of read responses or the fixed
+// size of exception responses.
+func readRTUResponse(r io.Reader, aduRequest []byte) ([]byte, error) {
+	// Unit id, function code and byte count or exception code.
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+
+	var remaining int
+	switch header[1] {
+	case aduRequest[1] | 0x80:
+		// Exception code is followed by the CRC only.
+		remaining = 2
+	case aduRequest[1]:
+		switch header[1] {
+		case modbus.FuncCodeReadCoils,
+			modbus.FuncCodeReadDiscreteInputs,
+			modbus.FuncCodeReadHoldingRegisters,
+			modbus.FuncCodeReadInputRegisters:
+			remaining = int(header[2]) + 2
+		default:
+			return nil, fmt.Errorf("modbus: unsupported function code '%v' for RTU framing", header[1])
+		}
+	default:
+		return nil, fmt.Errorf("modbus: response function code '%v' does not match request '%v'", header[1], aduRequest[1])
+	}
+
+	adu := make([]byte, len(header)+remaining)
+	copy(adu, header)
+	if _, err := io.ReadFull(r, adu[len(header):]); err != nil {
+		return nil, err
+	}
+
+	return adu, nil
+}
+
+// asciiMaxSize is the maximum length of an ASCII frame including the leading
+// colon and the trailing CRLF.
+const asciiMaxSize = 513
+
+// readASCIIResponse reads an ASCII frame, which is terminated by CRLF.
+func readASCIIResponse(r io.Reader, aduRequest []byte) ([]byte, error) {
+	adu := make([]byte, 0, asciiMaxSize)
+	b := make([]byte, 1)
+
+	// Read byte by byte to not consume anything beyond the end of the frame.
+	for len(adu) < asciiMaxSize {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+
+		// Skip anything preceding the start of the frame.
+		if len(adu) == 0 && b[0] != ':' {
+			continue
+		}
+
+		adu = append(adu, b[0])
+		if len(adu) >= 2 && adu[len(adu)-2] == '\r' && adu[len(adu)-1] == '\n' {
+			return adu, nil
+		}
+	}
+
+	return nil, fmt.Errorf("modbus: ASCII response exceeds maximum length of '%v'", asciiMaxSize)
+}
+
+const (
+	// udpAttempts is the number of times a request is sent via UDP before
+	// giving up. The timeout of the module is split evenly among them.
+	udpAttempts = 3
+	// mbapMaxSize is the maximum length of a MBAP frame.
+	mbapMaxSize = 260
+)
+
+// udpTransporter implements the modbus.Transporter interface for MBAP frames
+// sent as UDP datagrams. Datagrams can get lost, thus requests are
+// retransmitted and responses are matched on their transaction id.
+type udpTransporter struct {
+	address string
+	timeout time.Duration
+
+	conn net.Conn
+}
+
+func newUDPTransporter(address string, timeout time.Duration) *udpTransporter {
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+
+	return &udpTransporter{
+		address: address,
+		timeout: timeout,
+	}
+}
+
+// Connect creates a UDP socket bound to the target address.
+func (t *udpTransporter) Connect() error {
+	if t.conn != nil {
+		return nil
+	}
+
+	conn, err := net.DialTimeout("udp", t.address, t.timeout)
+	if err != nil {
+		return err
+	}
+	t.conn = conn
+
+	return nil
+}
+
+// Close closes the socket, if any.
+func (t *udpTransporter) Close() error {
+	if t.conn == nil {
+		return nil
+	}
+
+	err := t.conn.Close()
+	t.conn = nil
+	return err
+}
+
+// Send sends the request and waits for the response with the same transaction
+// id, retransmitting the request if none arrives in time.
+func (t *udpTransporter) Send(aduRequest []byte) ([]byte, error) {
+	if t.conn == nil {
+		if err := t.Connect(); err != nil {
+			return nil, err
+		}
+		defer t.Close()
+	}
+
+	transactionID := binary.BigEndian.Uint16(aduRequest)
+	interval := t.timeout / udpAttempts
+	data := make([]byte, mbapMaxSize)
+
+	for attempt := 0; attempt < udpAttempts; attempt++ {
+		if _, err := t.conn.Write(aduRequest); err != nil {
+			return nil, err
+		}
+
+		if err := t.conn.SetReadDeadline(time.Now().Add(interval)); err != nil {
+			return nil, err
+		}
+
+		for {
+			n, err := t.conn.Read(data)
+			if err != nil {
+				if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+					break
+				}
+				return nil, err
+			}
+
+			// Ignore late responses to earlier transactions.
+			if n < 8 || binary.BigEndian.Uint16(data) != transactionID {
+				continue
+			}
+
+			return data[:n], nil
+		}
+	}
+
+	return nil, fmt.Errorf("modbus: no response from %v after %v attempts within %v: i/o timeout",
+		t.address, udpAttempts, t.timeout)
+}
@@ -0,0 +1,135 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+	"unsafe"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/go-kit/log"
+	"github.com/tbrandon/mbserver"
+)
+
+// openPTY opens a pseudo-terminal pair. The returned master stands in for the
+// bus, the exporter opens the returned slave path as its serial device.
+func openPTY(t *testing.T) (*os.File, string) {
+	t.Helper()
+
+	master, err := os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		t.Skipf("pseudo-terminals not available: %v", err)
+	}
+	t.Cleanup(func() { master.Close() })
+
+	var unlock int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCSPTLCK, uintptr(unsafe.Pointer(&unlock))); errno != 0 {
+		t.Fatalf("failed to unlock pseudo-terminal: %v", errno)
+	}
+
+	var n uint32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, master.Fd(), syscall.TIOCGPTN, uintptr(unsafe.Pointer(&n))); errno != 0 {
+		t.Fatalf("failed to get pseudo-terminal number: %v", errno)
+	}
+
+	return master, fmt.Sprintf("/dev/pts/%d", n)
+}
+
+func TestScrapeRTU(t *testing.T) {
+	master, slave := openPTY(t)
+
+	s := mbserver.NewServer()
+	s.HoldingRegisters[22] = 240
+	s.InputRegisters[23] = 250
+	go serveRTU(s, master)
+
+	exporter := NewExporter(config.Config{
+		Modules: []config.Module{
+			{
+				Name:     "rtu",
+				Protocol: config.ModbusProtocolRTU,
+				Timeout:  1000,
+				Baudrate: 115200,
+				Databits: 8,
+				Stopbits: 1,
+				Parity:   "N",
+				Metrics: []config.MetricDef{
+					{
+						Name:       "holding",
+						Address:    300022,
+						DataType:   config.ModbusUInt16,
+						MetricType: config.MetricTypeGauge,
+					},
+					{
+						Name:       "input",
+						Address:    400023,
+						DataType:   config.ModbusUInt16,
+						MetricType: config.MetricTypeGauge,
+					},
+				},
+			},
+		},
+	}, log.NewNopLogger())
+
+	g, err := exporter.Scrape(slave, 1, "rtu")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := gatheredValue(t, g, "holding"); v != 240 {
+		t.Fatalf("expected holding register value 240 but got %v", v)
+	}
+	if v := gatheredValue(t, g, "input"); v != 250 {
+		t.Fatalf("expected input register value 250 but got %v", v)
+	}
+}
+
+func TestScrapeASCII(t *testing.T) {
+	master, slave := openPTY(t)
+
+	s := mbserver.NewServer()
+	s.HoldingRegisters[22] = 240
+	go serveASCII(s, master)
+
+	exporter := NewExporter(config.Config{
+		Modules: []config.Module{
+			{
+				Name:     "ascii",
+				Protocol: config.ModbusProtocolASCII,
+				Timeout:  1000,
+				Databits: 7,
+				Metrics: []config.MetricDef{
+					{
+						Name:       "holding",
+						Address:    300022,
+						DataType:   config.ModbusUInt16,
+						MetricType: config.MetricTypeGauge,
+					},
+				},
+			},
+		},
+	}, log.NewNopLogger())
+
+	g, err := exporter.Scrape(slave, 1, "ascii")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := gatheredValue(t, g, "holding"); v != 240 {
+		t.Fatalf("expected holding register value 240 but got %v", v)
+	}
+}
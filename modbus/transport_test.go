@@ -0,0 +1,442 @@
+// Copyright 2019 Richard Hartmann
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package modbus
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/RichiH/modbus_exporter/config"
+	"github.com/go-kit/log"
+	"github.com/goburrow/modbus"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tbrandon/mbserver"
+)
+
+// serverResponse runs a request PDU against the memory of the given mbserver
+// and returns the response PDU, so that tests can put mbserver behind framings
+// it does not support itself.
+func serverResponse(s *mbserver.Server, function byte, data []byte) (byte, []byte) {
+	var f func(*mbserver.Server, mbserver.Framer) ([]byte, *mbserver.Exception)
+	switch function {
+	case 1:
+		f = mbserver.ReadCoils
+	case 2:
+		f = mbserver.ReadDiscreteInputs
+	case 3:
+		f = mbserver.ReadHoldingRegisters
+	case 4:
+		f = mbserver.ReadInputRegisters
+	default:
+		return function | 0x80, []byte{byte(mbserver.IllegalFunction)}
+	}
+
+	response, exception := f(s, &mbserver.RTUFrame{Function: function, Data: data})
+	if *exception != mbserver.Success {
+		return function | 0x80, []byte{byte(*exception)}
+	}
+
+	return function, response
+}
+
+// serveRTU answers RTU read requests on rw until it is closed.
+func serveRTU(s *mbserver.Server, rw io.ReadWriter) {
+	// Read requests always consist of unit id, function code, address,
+	// quantity and CRC.
+	request := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(rw, request); err != nil {
+			return
+		}
+
+		frame, err := mbserver.NewRTUFrame(request)
+		if err != nil {
+			return
+		}
+
+		function, data := serverResponse(s, frame.Function, frame.Data)
+		response := &mbserver.RTUFrame{Address: frame.Address, Function: function, Data: data}
+		if _, err := rw.Write(response.Bytes()); err != nil {
+			return
+		}
+	}
+}
+
+// serveASCII answers ASCII requests on rw until it is closed.
+func serveASCII(s *mbserver.Server, rw io.ReadWriter) {
+	r := bufio.NewReader(rw)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err != nil {
+			return
+		}
+
+		// Strip colon and CRLF, then verify the LRC over all other bytes.
+		request, err := hex.DecodeString(string(bytes.TrimSpace(line[1:])))
+		if err != nil || len(request) < 3 || lrc(request[:len(request)-1]) != request[len(request)-1] {
+			return
+		}
+
+		function, data := serverResponse(s, request[1], request[2:len(request)-1])
+		response := append([]byte{request[0], function}, data...)
+		response = append(response, lrc(response))
+		if _, err := fmt.Fprintf(rw, ":%X\r\n", response); err != nil {
+			return
+		}
+	}
+}
+
+// lrc computes the longitudinal redundancy check of ASCII frames.
+func lrc(data []byte) byte {
+	var sum byte
+	for _, b := range data {
+		sum += b
+	}
+	return -sum
+}
+
+// listenTCP accepts connections on a local port and hands each of them to
+// serve. It returns the address to connect to.
+func listenTCP(t *testing.T, serve func(net.Conn)) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				serve(conn)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// gatheredValue returns the value of the first sample of the metric family
+// with the given name.
+func gatheredValue(t *testing.T, g prometheus.Gatherer, name string) float64 {
+	t.Helper()
+
+	metricFamilies, err := g.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, mf := range metricFamilies {
+		if mf.GetName() != name {
+			continue
+		}
+
+		m := mf.GetMetric()[0]
+		if m.GetGauge() != nil {
+			return m.GetGauge().GetValue()
+		}
+		return m.GetCounter().GetValue()
+	}
+
+	t.Fatalf("metric %v not found", name)
+	return 0
+}
+
+func TestNewTransporterSerialSettings(t *testing.T) {
+	module := &config.Module{
+		Protocol: config.ModbusProtocolRTU,
+		Baudrate: 9600,
+		Databits: 7,
+		Stopbits: 2,
+		Parity:   "N",
+	}
+
+	h, err := newTransporter(module, "/dev/ttyUSB0", log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler, ok := h.(*modbus.RTUClientHandler)
+	if !ok {
+		t.Fatal("expected an RTU client handler")
+	}
+
+	if handler.Address != "/dev/ttyUSB0" {
+		t.Fatalf("expected address to be the serial device but got %v", handler.Address)
+	}
+	if handler.BaudRate != 9600 || handler.DataBits != 7 || handler.StopBits != 2 || handler.Parity != "N" {
+		t.Fatalf("expected serial settings of the module to be applied but got %+v", handler.Config)
+	}
+	if handler.Timeout != defaultTimeout {
+		t.Fatalf("expected default timeout but got %v", handler.Timeout)
+	}
+
+	module.Timeout = 100
+	h, err = newTransporter(module, "/dev/ttyUSB0", log.NewNopLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler = h.(*modbus.RTUClientHandler)
+	if handler.Timeout != 100*time.Millisecond {
+		t.Fatalf("expected module timeout but got %v", handler.Timeout)
+	}
+}
+
+func TestNewTransporterASCIIDataBits(t *testing.T) {
+	for databits, expected := range map[int]int{0: 7, 8: 8} {
+		module := &config.Module{Protocol: config.ModbusProtocolASCII, Databits: databits}
+
+		h, err := newTransporter(module, "/dev/ttyUSB0", log.NewNopLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		handler, ok := h.(*modbus.ASCIIClientHandler)
+		if !ok {
+			t.Fatal("expected an ASCII client handler")
+		}
+		if handler.DataBits != expected {
+			t.Errorf("expected databits %v to select %v data bits but got %v", databits, expected, handler.DataBits)
+		}
+	}
+}
+
+func TestScrapeRTUOverTCP(t *testing.T) {
+	s := mbserver.NewServer()
+	s.HoldingRegisters[22] = 240
+	address := listenTCP(t, func(conn net.Conn) { serveRTU(s, conn) })
+
+	exporter := NewExporter(config.Config{
+		Modules: []config.Module{
+			{
+				Name:     "rtu-over-tcp",
+				Protocol: config.ModbusProtocolRTUOverTCP,
+				Timeout:  1000,
+				Metrics: []config.MetricDef{
+					{
+						Name:       "holding",
+						Address:    300022,
+						DataType:   config.ModbusInt32,
+						MetricType: config.MetricTypeGauge,
+					},
+				},
+			},
+		},
+	}, log.NewNopLogger())
+
+	g, err := exporter.Scrape(address, 1, "rtu-over-tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := gatheredValue(t, g, "holding"); v != 240<<16 {
+		t.Fatalf("expected holding register value %v but got %v", 240<<16, v)
+	}
+}
+
+func TestReadRTUResponse(t *testing.T) {
+	request := []byte{1, 3, 0, 22, 0, 1, 0, 0}
+
+	t.Run("read response", func(t *testing.T) {
+		response := []byte{1, 3, 2, 0, 240, 0xaa, 0xbb}
+		// Trailing bytes of a following frame must not be consumed.
+		r := bytes.NewReader(append(append([]byte{}, response...), 1, 3))
+
+		adu, err := readRTUResponse(r, request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(adu, response) {
+			t.Fatalf("expected %v but got %v", response, adu)
+		}
+	})
+
+	t.Run("exception response", func(t *testing.T) {
+		response := []byte{1, 0x83, 2, 0xaa, 0xbb}
+
+		adu, err := readRTUResponse(bytes.NewReader(response), request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(adu, response) {
+			t.Fatalf("expected %v but got %v", response, adu)
+		}
+	})
+
+	t.Run("unexpected function code", func(t *testing.T) {
+		response := []byte{1, 4, 2, 0, 240, 0xaa, 0xbb}
+
+		if _, err := readRTUResponse(bytes.NewReader(response), request); err == nil {
+			t.Fatal("expected an error but got nil")
+		}
+	})
+}
+
+func TestScrapeASCIIOverTCP(t *testing.T) {
+	s := mbserver.NewServer()
+	s.InputRegisters[23] = 250
+	address := listenTCP(t, func(conn net.Conn) { serveASCII(s, conn) })
+
+	exporter := NewExporter(config.Config{
+		Modules: []config.Module{
+			{
+				Name:     "ascii-over-tcp",
+				Protocol: config.ModbusProtocolASCIIOverTCP,
+				Timeout:  1000,
+				Metrics: []config.MetricDef{
+					{
+						Name:       "input",
+						Address:    400023,
+						DataType:   config.ModbusUInt16,
+						MetricType: config.MetricTypeGauge,
+					},
+				},
+			},
+		},
+	}, log.NewNopLogger())
+
+	g, err := exporter.Scrape(address, 1, "ascii-over-tcp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := gatheredValue(t, g, "input"); v != 250 {
+		t.Fatalf("expected input register value 250 but got %v", v)
+	}
+}
+
+func TestReadASCIIResponse(t *testing.T) {
+	response := []byte(":0103020032C8\r\n")
+	// Noise before the frame is skipped, the following frame is not consumed.
+	r := bytes.NewReader(append(append([]byte("\x00"), response...), ':'))
+
+	adu, err := readASCIIResponse(r, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(adu, response) {
+		t.Fatalf("expected %q but got %q", response, adu)
+	}
+
+	if _, err := readASCIIResponse(bytes.NewReader(bytes.Repeat([]byte(":"), asciiMaxSize+1)), nil); err == nil {
+		t.Fatal("expected an error for an unterminated frame but got nil")
+	}
+}
+
+func TestScrapeUDP(t *testing.T) {
+	s := mbserver.NewServer()
+	s.HoldingRegisters[22] = 240
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, mbapMaxSize)
+		for received := 0; ; received++ {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			// Drop the first datagram to force a retransmission.
+			if received == 0 {
+				continue
+			}
+
+			frame, err := mbserver.NewTCPFrame(buf[:n])
+			if err != nil {
+				return
+			}
+
+			function, data := serverResponse(s, frame.Function, frame.Data)
+			response := *frame
+			response.Function = function
+			response.Data = data
+
+			// A late response to an earlier transaction has to be ignored.
+			stale := response
+			stale.TransactionIdentifier--
+			stale.Data = []byte{2, 0, 0}
+			if _, err := conn.WriteTo(stale.Bytes(), addr); err != nil {
+				return
+			}
+
+			if _, err := conn.WriteTo(response.Bytes(), addr); err != nil {
+				return
+			}
+		}
+	}()
+
+	exporter := NewExporter(config.Config{
+		Modules: []config.Module{
+			{
+				Name:     "udp",
+				Protocol: config.ModbusProtocolUDP,
+				Timeout:  600,
+				Metrics: []config.MetricDef{
+					{
+						Name:       "holding",
+						Address:    300022,
+						DataType:   config.ModbusUInt16,
+						MetricType: config.MetricTypeGauge,
+					},
+				},
+			},
+		},
+	}, log.NewNopLogger())
+
+	g, err := exporter.Scrape(conn.LocalAddr().String(), 1, "udp")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := gatheredValue(t, g, "holding"); v != 240 {
+		t.Fatalf("expected holding register value 240 but got %v", v)
+	}
+}
+
+func TestUDPTransporterTimeout(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	transporter := newUDPTransporter(conn.LocalAddr().String(), 30*time.Millisecond)
+
+	start := time.Now()
+	_, err = transporter.Send([]byte{0, 1, 0, 0, 0, 6, 1, 3, 0, 22, 0, 1})
+	if err == nil {
+		t.Fatal("expected a timeout but got nil")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected to give up after the module timeout but took %v", elapsed)
+	}
+}
@@ -69,7 +69,8 @@ func main() {
 
 	http.Handle("/metrics", promhttp.HandlerFor(telemetryRegistry, promhttp.HandlerOpts{}))
 
-	exporter := modbus.NewExporter(config)
+	exporter := modbus.NewExporter(config, logger)
+	telemetryRegistry.MustRegister(exporter)
 	http.Handle("/modbus",
 		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			scrapeHandler(exporter, w, r, logger)
@@ -128,8 +129,8 @@ func scrapeHandler(e *modbus.Exporter, w http.ResponseWriter, r *http.Request, l
 	}
 
 	// In case of scraping error: sleep ScrapeErrorWait time and try again for ScrapeErrorRetryCount times.
-	// Try again if a race condition if happens where the same target is queried on different sub-targets,
-	// before a previous query has gotten a response.
+	// Transactions to the same target are serialized by the exporter, but some devices still need
+	// a moment to recover from transient errors.
 	ScrapeErrorRetryCount := e.Config.GetModule(moduleName).Workarounds.ScrapeErrorRetryCount // int cannot be nil, can arise issue if user wants to set it to 0
 	ScrapeErrorWait := e.Config.GetModule(moduleName).Workarounds.ScrapeErrorWait
 
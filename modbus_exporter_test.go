@@ -93,7 +93,7 @@ func TestScrapeHandler(t *testing.T) {
 
 		t.Run(test.name, func(t *testing.T) {
 			config := test.config()
-			exporter := modbus.NewExporter(config)
+			exporter := modbus.NewExporter(config, log.NewNopLogger())
 
 			req, err := http.NewRequest("GET", "/metrics", nil)
 			if err != nil {